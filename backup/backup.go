@@ -0,0 +1,222 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// manifestFile is the name of the manifest within a backup
+const manifestFile = "manifest.yaml"
+
+// Entry records a file or directory that was moved into a backup
+type Entry struct {
+	// Path is where the file was found
+	Path string `yaml:"path"`
+	// Backup is where the file was moved to, relative to the backup
+	Backup string `yaml:"backup"`
+}
+
+// Manifest lists the contents of a backup
+type Manifest struct {
+	Created string  `yaml:"created"`
+	Entries []Entry `yaml:"entries"`
+}
+
+// Backup moves files aside rather than removing them. A backup is created
+// in `$ALTERANT_HOME/backups/<timestamp>` once the first file is moved.
+type Backup struct {
+	mu       sync.Mutex
+	dir      string
+	manifest Manifest
+}
+
+func backupsDir() string {
+	return path.Join(os.Getenv("ALTERANT_HOME"), "backups")
+}
+
+// New returns a backup for the files moved aside by this run
+func New() *Backup {
+	return &Backup{}
+}
+
+// create chooses a directory for the backup that no other backup uses
+func (b *Backup) create() error {
+	now := time.Now()
+	name := now.Format("20060102T150405")
+
+	dir := path.Join(backupsDir(), name)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			break
+		}
+
+		dir = path.Join(backupsDir(), fmt.Sprintf("%s-%d", name, i))
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	b.dir = dir
+	b.manifest.Created = now.Format(time.RFC3339)
+
+	return nil
+}
+
+// Save moves the file or directory at file into the backup and records it in
+// the manifest. It returns where the file was moved to.
+func (b *Backup) Save(file string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.dir == "" {
+		err := b.create()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	entry := Entry{Path: file, Backup: path.Clean("./" + file)}
+	moved := path.Join(b.dir, entry.Backup)
+
+	err := os.MkdirAll(path.Dir(moved), 0700)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Rename(file, moved)
+	if err != nil {
+		return "", err
+	}
+
+	b.manifest.Entries = append(b.manifest.Entries, entry)
+
+	// the manifest is written after every file, so that it is complete even
+	// if alterant fails part way through
+	err = writeManifest(b.dir, &b.manifest)
+	if err != nil {
+		return "", err
+	}
+
+	return moved, nil
+}
+
+func writeManifest(dir string, m *Manifest) error {
+	b, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(dir, manifestFile), b, 0600)
+}
+
+// ReadManifest reads the manifest of the named backup
+func ReadManifest(name string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(path.Join(backupsDir(), name, manifestFile))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Unknown backup: %s", name)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+
+	err = yaml.Unmarshal(b, m)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// List returns the names of the backups, oldest first
+func List() ([]string, error) {
+	infos, err := ioutil.ReadDir(backupsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+
+		if _, err := os.Stat(path.Join(backupsDir(), info.Name(), manifestFile)); err == nil {
+			names = append(names, info.Name())
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Restore moves the files of the named backup back to where they were found.
+// Symlinks that have since taken their place are removed, whereas any other
+// file is only replaced when forced. Restored files are removed from the
+// manifest, and the backup is removed once every file has been restored.
+func Restore(name string, force bool, restored func(Entry)) error {
+	m, err := ReadManifest(name)
+	if err != nil {
+		return err
+	}
+
+	dir := path.Join(backupsDir(), name)
+
+	for len(m.Entries) > 0 {
+		entry := m.Entries[0]
+
+		err = restore(dir, entry, force)
+		if err != nil {
+			return err
+		}
+
+		m.Entries = m.Entries[1:]
+
+		err = writeManifest(dir, m)
+		if err != nil {
+			return err
+		}
+
+		if restored != nil {
+			restored(entry)
+		}
+	}
+
+	return os.RemoveAll(dir)
+}
+
+func restore(dir string, entry Entry, force bool) error {
+	if stat, err := os.Lstat(entry.Path); err == nil {
+		if stat.Mode()&os.ModeSymlink == 0 && !force {
+			return fmt.Errorf("Cannot restore %s, the path is in use", entry.Path)
+		}
+
+		err = os.RemoveAll(entry.Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := os.MkdirAll(path.Dir(entry.Path), 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path.Join(dir, entry.Backup), entry.Path)
+}
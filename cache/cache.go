@@ -1,86 +1,402 @@
 package cache
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
+	"time"
 
 	"gopkg.in/yaml.v2"
 
 	"github.com/autonomy/alterant/config"
+	"github.com/autonomy/alterant/link"
 	"github.com/autonomy/alterant/task"
 )
 
+// Version is the schema version of db.yaml written by this version of alterant
+const Version = 2
+
+// lockTimeout is how long to wait for another alterant process to release db.yaml
+const lockTimeout = 10 * time.Second
+
+// Link records a link as it was applied
+type Link struct {
+	SHA1        string `yaml:"sha1"`
+	Target      string `yaml:"target"`
+	Destination string `yaml:"destination"`
+	Template    bool   `yaml:"template,omitempty"`
+	Mode        string `yaml:"mode,omitempty"`
+	Content     string `yaml:"content,omitempty"`
+	Applied     string `yaml:"applied,omitempty"`
+	Commit      string `yaml:"commit,omitempty"`
+}
+
+// Command records the outcome of a command
+type Command struct {
+	SHA1       string `yaml:"sha1"`
+	Applied    string `yaml:"applied,omitempty"`
+	ExitStatus int    `yaml:"exit_status"`
+	Duration   string `yaml:"duration,omitempty"`
+	Commit     string `yaml:"commit,omitempty"`
+}
+
+// Task records a provisioned task
 type Task struct {
-	Links    []string `yaml:"links"`
-	Commands []string `yaml:"commands"`
-	SHA1     string   `yaml:"sha1"`
+	Links    []Link    `yaml:"links"`
+	Commands []Command `yaml:"commands"`
+	SHA1     string    `yaml:"sha1"`
 }
 
+// Machine records a provisioned machine
 type Machine struct {
-	Tasks map[string]Task `yaml:"tasks"`
-	SHA1  string          `yaml:"sha1"`
+	Tasks  map[string]Task `yaml:"tasks"`
+	SHA1   string          `yaml:"sha1"`
+	Commit string          `yaml:"commit,omitempty"`
 }
 
+// Cache represents `db.yaml`, the record of every provisioned machine
 type Cache struct {
+	Version  int                `yaml:"version"`
 	Machines map[string]Machine `yaml:"machines"`
 }
 
-func (c *Cache) AddTask(machine Machine, task *task.Task) {
-	t := Task{}
+func cacheFile() string {
+	return path.Join(os.Getenv("ALTERANT_HOME"), "db.yaml")
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+// Link returns the record of the link with the given SHA1, or nil
+func (t *Task) Link(SHA1 string) *Link {
+	for i := range t.Links {
+		if t.Links[i].SHA1 == SHA1 {
+			return &t.Links[i]
+		}
+	}
+
+	return nil
+}
+
+// Provisioned returns true if the link is known to have been created
+func (l *Link) Provisioned() bool {
+	return l.Applied != ""
+}
+
+// ToLink returns the link as it was provisioned
+func (l *Link) ToLink() *link.Link {
+	return &link.Link{
+		Target:      link.SymlinkTarget(l.Target),
+		Destination: link.SymlinkDestination(l.Destination),
+		Template:    l.Template,
+		Mode:        l.Mode,
+		SHA1:        l.SHA1,
+		Content:     l.Content,
+	}
+}
+
+// Succeeded returns true if the command completed successfully
+func (c *Command) Succeeded() bool {
+	return c.ExitStatus == 0
+}
+
+// Command returns the record of the command with the given SHA1, or nil
+func (t *Task) Command(SHA1 string) *Command {
+	for i := range t.Commands {
+		if t.Commands[i].SHA1 == SHA1 {
+			return &t.Commands[i]
+		}
+	}
+
+	return nil
+}
+
+// link returns the record of a link in any of the machine's tasks, which
+// allows records to follow links into renamed tasks
+func (m *Machine) link(SHA1 string) *Link {
+	for _, t := range m.Tasks {
+		if l := t.Link(SHA1); l != nil {
+			return l
+		}
+	}
+
+	return nil
+}
+
+func (m *Machine) command(SHA1 string) *Command {
+	for _, t := range m.Tasks {
+		if c := t.Command(SHA1); c != nil {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// newTask records a task, carrying over the records of the links and commands
+// that were not applied in this run from the previously cached machine. Links
+// and commands that have never been applied, and commands that failed, are not
+// recorded, so that they are attempted again by the next update.
+func newTask(task *task.Task, previous Machine, commit string) Task {
+	t := Task{SHA1: task.SHA1}
 
 	for _, link := range task.Links {
-		t.Links = append(t.Links, link.SHA1)
+		l := Link{
+			SHA1:        link.SHA1,
+			Target:      string(link.Target),
+			Destination: string(link.Destination),
+			Template:    link.Template,
+			Mode:        link.Mode,
+		}
+
+		if !link.Applied.IsZero() {
+			l.Content = link.Content
+			l.Applied = formatTime(link.Applied)
+			l.Commit = commit
+		} else if prev := previous.link(link.SHA1); prev != nil {
+			l = *prev
+		} else {
+			continue
+		}
+
+		t.Links = append(t.Links, l)
 	}
 
 	for _, command := range task.Commands {
-		t.Commands = append(t.Commands, command.SHA1)
+		c := Command{SHA1: command.SHA1}
+
+		if !command.Applied.IsZero() {
+			if command.ExitStatus != 0 {
+				continue
+			}
+
+			c.Applied = formatTime(command.Applied)
+			c.ExitStatus = command.ExitStatus
+			c.Duration = command.Duration.String()
+			c.Commit = commit
+		} else if prev := previous.command(command.SHA1); prev != nil {
+			c = *prev
+		} else {
+			continue
+		}
+
+		t.Commands = append(t.Commands, c)
 	}
 
-	t.SHA1 = task.SHA1
+	return t
+}
+
+// WriteTask records the outcome of a single task as soon as it has been
+// attempted, so that the cache reflects what was applied even if a later task
+// fails. A failed task is recorded without its SHA1 so that it is attempted
+// again by the next update.
+func WriteTask(machine string, commit string, task *task.Task, failed bool) error {
+	return Update(func(c *Cache) error {
+		m, ok := c.Machines[machine]
+		if !ok {
+			m = Machine{Tasks: make(map[string]Task)}
+		}
+
+		t := newTask(task, m, commit)
+		if failed {
+			t.SHA1 = ""
+		}
+
+		m.Tasks[task.Name] = t
 
-	machine.Tasks[task.Name] = t
+		// the machine is only up to date once every task has been provisioned
+		m.SHA1 = ""
+		c.Machines[machine] = m
+
+		return nil
+	})
 }
 
-func WriteToFile(cfg *config.Config) error {
-	cache := Cache{}
-	m := Machine{}
+// WriteToFile records the machine's tasks in the cache, leaving the records of
+// other machines intact
+func WriteToFile(cfg *config.Config, commit string) error {
+	return Update(func(c *Cache) error {
+		previous := c.Machines[cfg.Machine]
+
+		m := Machine{
+			Tasks:  make(map[string]Task),
+			SHA1:   cfg.SHA1,
+			Commit: commit,
+		}
+
+		for _, task := range cfg.Tasks {
+			m.Tasks[task.Name] = newTask(task, previous, commit)
+		}
+
+		c.Machines[cfg.Machine] = m
+
+		return nil
+	})
+}
 
-	cache.Machines = make(map[string]Machine)
-	m.Tasks = make(map[string]Task)
+// RemoveTasks removes the named tasks of a machine from the cache, dropping
+// the machine entirely once it has no remaining tasks
+func RemoveTasks(machine string, names []string) error {
+	return Update(func(c *Cache) error {
+		m, ok := c.Machines[machine]
+		if !ok {
+			return nil
+		}
 
-	for _, task := range cfg.Tasks {
-		cache.AddTask(m, task)
+		for _, name := range names {
+			delete(m.Tasks, name)
+		}
+
+		// the machine no longer matches its config, so clear the SHA1 to ensure
+		// that the next update takes a closer look
+		m.SHA1 = ""
+		c.Machines[machine] = m
+
+		if len(m.Tasks) == 0 {
+			delete(c.Machines, machine)
+		}
+
+		return nil
+	})
+}
+
+// Update reads the cache, applies fn and writes the result while holding a
+// lock, so that concurrent alterant processes do not overwrite each other
+func Update(fn func(*Cache) error) error {
+	unlock, err := lock()
+	if err != nil {
+		return err
 	}
+	defer unlock()
 
-	m.SHA1 = cfg.SHA1
+	c, err := ReadCache()
+	if err != nil {
+		return err
+	}
 
-	cache.Machines[cfg.Machine] = m
+	err = fn(c)
+	if err != nil {
+		return err
+	}
 
-	d, err := yaml.Marshal(&cache)
+	return c.write()
+}
+
+func lock() (func(), error) {
+	file := cacheFile() + ".lock"
+	deadline := time.Now().Add(lockTimeout)
+
+	for {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+
+			return func() { os.Remove(file) }, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Timed out waiting for lock, remove %s if no other alterant process is running", file)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// write replaces db.yaml atomically by renaming a temporary file over it
+func (c *Cache) write() error {
+	c.Version = Version
+
+	d, err := yaml.Marshal(c)
 	if err != nil {
 		return err
 	}
 
-	err = ioutil.WriteFile(os.Getenv("ALTERANT_HOME")+"/db.yaml", d, 0644)
+	f, err := ioutil.TempFile(os.Getenv("ALTERANT_HOME"), "db.yaml.")
 	if err != nil {
 		return err
 	}
 
+	_, err = f.Write(d)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), cacheFile())
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
 	return nil
 }
 
+// ReadCache reads db.yaml, returning an empty cache if nothing has been
+// provisioned yet
 func ReadCache() (*Cache, error) {
-	bytes, err := ioutil.ReadFile(os.Getenv("ALTERANT_HOME") + "/db.yaml")
+	c := &Cache{
+		Version:  Version,
+		Machines: make(map[string]Machine),
+	}
+
+	bytes, err := ioutil.ReadFile(cacheFile())
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+
 	if err != nil {
 		return nil, err
 	}
 
-	c := &Cache{}
-
-	err = yaml.Unmarshal(bytes, &c)
+	err = unmarshal(bytes, c)
 	if err != nil {
 		return nil, err
 	}
 
+	if c.Version > Version {
+		return nil, fmt.Errorf("%s has schema version %d, this version of alterant supports up to %d", cacheFile(), c.Version, Version)
+	}
+
+	if c.Machines == nil {
+		c.Machines = make(map[string]Machine)
+	}
+
 	return c, nil
 }
+
+// ReadMachine returns the cached machine, or nil if it has not been
+// provisioned
+func ReadMachine(machine string) (*Machine, error) {
+	c, err := ReadCache()
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := c.Machines[machine]
+	if !ok {
+		return nil, nil
+	}
+
+	return &m, nil
+}
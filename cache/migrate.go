@@ -0,0 +1,73 @@
+package cache
+
+import "gopkg.in/yaml.v2"
+
+// taskV1 is a task as recorded by schema version 1, which only stored the
+// SHA1s of links and commands
+type taskV1 struct {
+	Links    []string `yaml:"links"`
+	Commands []string `yaml:"commands"`
+	SHA1     string   `yaml:"sha1"`
+}
+
+type machineV1 struct {
+	Tasks map[string]taskV1 `yaml:"tasks"`
+	SHA1  string            `yaml:"sha1"`
+}
+
+type cacheV1 struct {
+	Machines map[string]machineV1 `yaml:"machines"`
+}
+
+func migrateV1(v1 *cacheV1, c *Cache) {
+	for name, m := range v1.Machines {
+		machine := Machine{
+			Tasks: make(map[string]Task),
+			SHA1:  m.SHA1,
+		}
+
+		for taskName, t := range m.Tasks {
+			task := Task{SHA1: t.SHA1}
+
+			for _, SHA1 := range t.Links {
+				task.Links = append(task.Links, Link{SHA1: SHA1})
+			}
+
+			for _, SHA1 := range t.Commands {
+				task.Commands = append(task.Commands, Command{SHA1: SHA1})
+			}
+
+			machine.Tasks[taskName] = task
+		}
+
+		c.Machines[name] = machine
+	}
+}
+
+// unmarshal decodes db.yaml into c, migrating older schema versions
+func unmarshal(b []byte, c *Cache) error {
+	var header struct {
+		Version int `yaml:"version"`
+	}
+
+	err := yaml.Unmarshal(b, &header)
+	if err != nil {
+		return err
+	}
+
+	// caches written before the schema was versioned are version 1
+	if header.Version <= 1 {
+		v1 := &cacheV1{}
+
+		err = yaml.Unmarshal(b, v1)
+		if err != nil {
+			return err
+		}
+
+		migrateV1(v1, c)
+
+		return nil
+	}
+
+	return yaml.Unmarshal(b, c)
+}
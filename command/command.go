@@ -1,32 +1,49 @@
 package command
 
 import (
+	"time"
+
+	"github.com/autonomy/alterant/condition"
 	"github.com/autonomy/alterant/hasher"
 	"gopkg.in/yaml.v2"
 )
 
 type Command struct {
-	Contents string
-	Queued   bool
-	SHA1     string
+	Contents   string
+	When       *condition.Condition `yaml:"-"`
+	Queued     bool
+	SHA1       string
+	Applied    time.Time     `yaml:"-"`
+	Duration   time.Duration `yaml:"-"`
+	ExitStatus int           `yaml:"-"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface
 func (c *Command) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	var aux string
+	var aux struct {
+		Run  string               `yaml:"run"`
+		When *condition.Condition `yaml:"when"`
+	}
 
-	err := unmarshal(&aux)
+	// a command is either a string, or a mapping when it has a condition
+	err := unmarshal(&aux.Run)
 	if err != nil {
-		return err
+		err = unmarshal(&aux)
+		if err != nil {
+			return err
+		}
 	}
 
-	b, err := yaml.Marshal(&aux)
+	// the condition decides whether the command is run, not what it runs, so
+	// only the contents are hashed
+	b, err := yaml.Marshal(&aux.Run)
 	if err != nil {
 		return err
 	}
 
 	*c = Command{
-		Contents: aux,
+		Contents: aux.Run,
+		When:     aux.When,
 		Queued:   true,
 		SHA1:     hasher.SHA1FromBytes(b),
 	}
@@ -1,8 +1,13 @@
 package commander
 
-import "github.com/autonomy/alterant/task"
+import (
+	"github.com/autonomy/alterant/logger"
+	"github.com/autonomy/alterant/task"
+)
 
 // Commander is the interface for command execution
 type Commander interface {
 	Execute(*task.Task) error
+	Teardown(*task.Task) error
+	WithLogger(*logWrapper.LogWrapper) Commander
 }
@@ -1,9 +1,12 @@
 package commander
 
 import (
-	"os"
+	"fmt"
 	"os/exec"
+	"syscall"
+	"time"
 
+	"github.com/autonomy/alterant/command"
 	"github.com/autonomy/alterant/logger"
 	"github.com/autonomy/alterant/task"
 )
@@ -12,16 +15,43 @@ import (
 type DefaultCommander struct {
 	logger  *logWrapper.LogWrapper
 	enabled bool
+	dryRun  bool
 }
 
-// Execute executes the command on the system
-func (dc *DefaultCommander) Execute(t *task.Task) error {
+// exitStatus returns the exit status of a command from the error returned by
+// running it
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+
+	return -1
+}
+
+func (dc *DefaultCommander) run(commands []*command.Command) error {
 	// do not execute commands if not enabled
 	if !dc.enabled {
 		return nil
 	}
 
-	for _, taskCmd := range t.Commands {
+	for _, taskCmd := range commands {
+		if dc.dryRun {
+			action := "unchanged"
+			if taskCmd.Queued {
+				action = "run"
+			}
+
+			fmt.Printf("    command %s:\n%s\n", action, taskCmd.Contents)
+
+			continue
+		}
+
 		if !taskCmd.Queued {
 			continue
 		}
@@ -31,13 +61,17 @@ func (dc *DefaultCommander) Execute(t *task.Task) error {
 		cmd := exec.Command(cmdName, cmdArgs...)
 
 		if dc.logger.Verbose {
-			cmd.Stderr = os.Stderr
-			cmd.Stdout = os.Stdout
-			cmd.Stdin = os.Stdin
+			cmd.Stderr = dc.logger.Stderr()
+			cmd.Stdout = dc.logger.Stdout()
+			cmd.Stdin = dc.logger.Stdin()
 		}
 
 		dc.logger.Info(2, "Executing command: \n%s", taskCmd.Contents)
+
+		taskCmd.Applied = time.Now()
 		err := cmd.Run()
+		taskCmd.Duration = time.Since(taskCmd.Applied)
+		taskCmd.ExitStatus = exitStatus(err)
 		if err != nil {
 			return err
 		}
@@ -46,10 +80,29 @@ func (dc *DefaultCommander) Execute(t *task.Task) error {
 	return nil
 }
 
+// Execute executes the command on the system
+func (dc *DefaultCommander) Execute(t *task.Task) error {
+	return dc.run(t.Commands)
+}
+
+// Teardown executes the teardown commands of a task on the system
+func (dc *DefaultCommander) Teardown(t *task.Task) error {
+	return dc.run(t.Teardown)
+}
+
+// WithLogger returns a copy of the commander that logs to logger
+func (dc *DefaultCommander) WithLogger(logger *logWrapper.LogWrapper) Commander {
+	c := *dc
+	c.logger = logger
+
+	return &c
+}
+
 // NewDefaultCommander returns an instance of `DefaultLinker`
-func NewDefaultCommander(enabled bool, logger *logWrapper.LogWrapper) *DefaultCommander {
+func NewDefaultCommander(enabled bool, dryRun bool, logger *logWrapper.LogWrapper) *DefaultCommander {
 	return &DefaultCommander{
 		logger:  logger,
 		enabled: enabled,
+		dryRun:  dryRun,
 	}
 }
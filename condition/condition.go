@@ -0,0 +1,160 @@
+package condition
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// List is a list of strings that may also be written as a single string
+type List []string
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface
+func (l *List) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var aux string
+
+	if err := unmarshal(&aux); err == nil {
+		*l = List{aux}
+		return nil
+	}
+
+	var list []string
+
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+
+	*l = List(list)
+
+	return nil
+}
+
+// Condition represents a `when` clause. Every part of the condition that is
+// declared must be met, and a part is met if any of its values is.
+type Condition struct {
+	// OS is matched against runtime.GOOS
+	OS List `yaml:"os,omitempty"`
+	// Hostname is matched against the full or short hostname
+	Hostname List `yaml:"hostname,omitempty"`
+	// Executable is the name of an executable in the PATH
+	Executable List `yaml:"executable,omitempty"`
+	// Env is the name of a variable that is set, or NAME=value to require a
+	// specific value
+	Env List `yaml:"env,omitempty"`
+}
+
+func anyOf(values List, fn func(string) bool) bool {
+	if len(values) == 0 {
+		return true
+	}
+
+	for _, value := range values {
+		if fn(value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hostname(name string) bool {
+	host, err := os.Hostname()
+	if err != nil {
+		return false
+	}
+
+	return name == host || name == strings.SplitN(host, ".", 2)[0]
+}
+
+func executable(name string) bool {
+	_, err := exec.LookPath(name)
+
+	return err == nil
+}
+
+// lookupEnv looks up a variable in the machine's environment, falling back to
+// the environment of the process
+func lookupEnv(name string, environment map[string]string) string {
+	for variable, value := range environment {
+		if os.ExpandEnv(variable) == name {
+			return os.ExpandEnv(value)
+		}
+	}
+
+	return os.Getenv(name)
+}
+
+// Met returns true if the condition is met on this host. The environment of
+// the machine takes precedence over the environment of the process. A nil
+// condition is always met.
+func (c *Condition) Met(environment map[string]string) bool {
+	if c == nil {
+		return true
+	}
+
+	env := func(value string) bool {
+		parts := strings.SplitN(value, "=", 2)
+		actual := lookupEnv(parts[0], environment)
+
+		if len(parts) == 1 {
+			return actual != ""
+		}
+
+		return actual == parts[1]
+	}
+
+	return anyOf(c.OS, func(value string) bool { return value == runtime.GOOS }) &&
+		anyOf(c.Hostname, hostname) &&
+		anyOf(c.Executable, executable) &&
+		anyOf(c.Env, env)
+}
+
+// excludes returns true if the values of a and b are declared, and none of
+// them can be met together
+func excludes(a List, b List, compatible func(string, string) bool) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+
+	for _, x := range a {
+		for _, y := range b {
+			if compatible(x, y) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func shortName(name string) string {
+	return strings.SplitN(name, ".", 2)[0]
+}
+
+// Excludes returns true if the condition and other cannot both be met on the
+// same host, as they require a different os, hostname or value of an
+// environment variable. A nil condition is always met.
+func (c *Condition) Excludes(other *Condition) bool {
+	if c == nil || other == nil {
+		return false
+	}
+
+	equal := func(a, b string) bool { return a == b }
+
+	// a short hostname is met by any full hostname that begins with it
+	hostname := func(a, b string) bool {
+		return a == b || a == shortName(b) || shortName(a) == b
+	}
+
+	env := func(a, b string) bool {
+		x := strings.SplitN(a, "=", 2)
+		y := strings.SplitN(b, "=", 2)
+
+		return len(x) == 1 || len(y) == 1 || x[0] != y[0] || x[1] == y[1]
+	}
+
+	return excludes(c.OS, other.OS, equal) ||
+		excludes(c.Hostname, other.Hostname, hostname) ||
+		excludes(c.Env, other.Env, env)
+}
@@ -2,30 +2,109 @@ package config
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
+	"runtime"
+	"sort"
 
 	"gopkg.in/yaml.v2"
 
 	"github.com/autonomy/alterant/hasher"
+	"github.com/autonomy/alterant/link"
 	"github.com/autonomy/alterant/task"
 	"github.com/deckarep/golang-set"
 )
 
+// The modes of an update strategy
+const (
+	// Incremental updates only the tasks that have changed
+	Incremental = "incremental"
+	// Full provisions every task again
+	Full = "full"
+	// Clean removes every managed link before provisioning every task again
+	Clean = "clean"
+)
+
+// TaskStrategy overrides the update strategy of a single task
+type TaskStrategy struct {
+	// AlwaysRun provisions the task on every update, even if it is unchanged
+	AlwaysRun bool `yaml:"always_run"`
+}
+
+// UpdateStrategy represents the `update_strategy` section of `machine.yaml`
+type UpdateStrategy struct {
+	Mode string `yaml:"mode"`
+
+	// Propagate queues all transitive dependents of a changed task, rather
+	// than only its direct dependents
+	Propagate bool `yaml:"propagate"`
+
+	Tasks map[string]TaskStrategy `yaml:"tasks"`
+}
+
+// Forces returns true if the strategy provisions the named task on every
+// update
+func (s *UpdateStrategy) Forces(name string) bool {
+	return s.Mode == Full || s.Mode == Clean || s.Tasks[name].AlwaysRun
+}
+
+// ForcesAny returns true if the strategy provisions any task on every update
+func (s *UpdateStrategy) ForcesAny() bool {
+	if s.Mode == Full || s.Mode == Clean {
+		return true
+	}
+
+	for _, t := range s.Tasks {
+		if t.AlwaysRun {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *UpdateStrategy) validate(tasks map[string]*task.Task) error {
+	switch s.Mode {
+	case "":
+		s.Mode = Incremental
+	case Incremental, Full, Clean:
+	default:
+		return fmt.Errorf("Unknown update strategy mode: %s", s.Mode)
+	}
+
+	for name := range s.Tasks {
+		if _, ok := tasks[name]; !ok {
+			return fmt.Errorf("Unknown task in update strategy: %s", name)
+		}
+	}
+
+	return nil
+}
+
 // Config represents `machine.yaml`
 type Config struct {
-	Machine     string
-	Environment map[string]string
-	Tasks       []*task.Task
-	SHA1        string
+	Machine        string
+	Environment    map[string]string
+	Tasks          []*task.Task
+	Layers         [][]*task.Task
+	UpdateStrategy UpdateStrategy
+	SHA1           string
+
+	dependents map[string][]string
+	// tags are the tags of every declared task, including those whose
+	// conditions are not met on this host
+	tags map[string]bool
+
+	// extensions are the machines that the machine extends
+	extensions []*extension
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface
 func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var aux struct {
-		Environment map[string]string     `yaml:"environment"`
-		Tasks       map[string]*task.Task `yaml:"tasks"`
+		Environment    map[string]string     `yaml:"environment"`
+		Tasks          map[string]*task.Task `yaml:"tasks"`
+		UpdateStrategy UpdateStrategy        `yaml:"update_strategy"`
 	}
 
 	err := unmarshal(&aux)
@@ -37,30 +116,277 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		task.Name = name
 	}
 
-	b, err := yaml.Marshal(&aux)
+	err = aux.UpdateStrategy.validate(aux.Tasks)
+	if err != nil {
+		return err
+	}
+
+	tags := make(map[string]bool)
+	for _, task := range aux.Tasks {
+		for _, tag := range task.Tags {
+			tags[tag] = true
+		}
+	}
+
+	err = filterTasks(aux.Tasks, aux.Environment)
+	if err != nil {
+		return err
+	}
+
+	SHA1, err := hash(aux.Environment, aux.Tasks)
 	if err != nil {
 		return err
 	}
 
-	tasks, err := resolveDependencies(aux.Tasks)
+	layers, err := resolveDependencies(aux.Tasks)
 	if err != nil {
 		return err
 	}
 
+	var tasks []*task.Task
+	for _, layer := range layers {
+		tasks = append(tasks, layer...)
+	}
+
 	*c = Config{
-		Environment: aux.Environment,
-		Tasks:       tasks,
-		SHA1:        hasher.SHA1FromBytes(b),
+		Environment:    aux.Environment,
+		Tasks:          tasks,
+		Layers:         layers,
+		UpdateStrategy: aux.UpdateStrategy,
+		SHA1:           SHA1,
+		dependents:     dependentsOf(aux.Tasks),
+		tags:           tags,
 	}
 
 	return nil
 }
+
+// hash returns the SHA1 of a machine. The update strategy does not alter the
+// machine, so it is not hashed.
+func hash(environment map[string]string, tasks map[string]*task.Task) (string, error) {
+	hashed := struct {
+		Environment map[string]string     `yaml:"environment"`
+		Tasks       map[string]*task.Task `yaml:"tasks"`
+	}{environment, tasks}
+
+	b, err := yaml.Marshal(&hashed)
+	if err != nil {
+		return "", err
+	}
+
+	return hasher.SHA1FromBytes(b), nil
+}
+
+// filterTasks removes the tasks, links and commands whose conditions are not
+// met on this host. Dependencies on removed tasks are dropped, as they do not
+// apply to this host.
+func filterTasks(tasks map[string]*task.Task, environment map[string]string) error {
+	excluded := make(map[string]bool)
+
+	for name, t := range tasks {
+		if !t.When.Met(environment) {
+			excluded[name] = true
+			delete(tasks, name)
+		}
+	}
+
+	for _, t := range tasks {
+		var dependencies []string
+		for _, dep := range t.Dependencies {
+			if !excluded[dep] {
+				dependencies = append(dependencies, dep)
+			}
+		}
+
+		t.Dependencies = dependencies
+
+		err := t.Filter(environment)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dependentsOf inverts the dependency graph, mapping each task to the tasks
+// that directly depend on it
+func dependentsOf(tasks map[string]*task.Task) map[string][]string {
+	dependents := make(map[string][]string)
+
+	for name, task := range tasks {
+		for _, dep := range task.Dependencies {
+			dependents[dep] = append(dependents[dep], name)
+		}
+	}
+
+	return dependents
+}
+
+// Dependents returns the tasks that directly depend on the named task, in
+// the order that they are provisioned
+func (c *Config) Dependents(name string) []*task.Task {
+	var tasks []*task.Task
+
+	for _, t := range c.Tasks {
+		for _, dependent := range c.dependents[name] {
+			if t.Name == dependent {
+				tasks = append(tasks, t)
+			}
+		}
+	}
+
+	return tasks
+}
+
+// TransitiveDependents returns the tasks that directly or indirectly depend
+// on the named task, in the order that they are provisioned
+func (c *Config) TransitiveDependents(name string) []*task.Task {
+	seen := map[string]bool{name: true}
+	queue := []string{name}
+
+	for len(queue) != 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		for _, dependent := range c.dependents[current] {
+			if !seen[dependent] {
+				seen[dependent] = true
+				queue = append(queue, dependent)
+			}
+		}
+	}
+
+	var tasks []*task.Task
+	for _, t := range c.Tasks {
+		if t.Name != name && seen[t.Name] {
+			tasks = append(tasks, t)
+		}
+	}
+
+	return tasks
+}
+
+// TransitiveDependencies returns the tasks that the named task directly or
+// indirectly depends on, in the order that they are provisioned
+func (c *Config) TransitiveDependencies(name string) []*task.Task {
+	seen := map[string]bool{name: true}
+	queue := []string{name}
+
+	for len(queue) != 0 {
+		current := c.Task(queue[0])
+		queue = queue[1:]
+
+		if current == nil {
+			continue
+		}
+
+		for _, dep := range current.Dependencies {
+			if !seen[dep] {
+				seen[dep] = true
+				queue = append(queue, dep)
+			}
+		}
+	}
+
+	var tasks []*task.Task
+	for _, t := range c.Tasks {
+		if t.Name != name && seen[t.Name] {
+			tasks = append(tasks, t)
+		}
+	}
+
+	return tasks
+}
+
+// Selection selects a subset of a machine's tasks by name or by tag
+type Selection struct {
+	Tasks    []string
+	Skip     []string
+	Tags     []string
+	SkipTags []string
+}
+
+// Empty returns true if the selection selects every task
+func (s *Selection) Empty() bool {
+	return len(s.Tasks) == 0 && len(s.Skip) == 0 && len(s.Tags) == 0 && len(s.SkipTags) == 0
+}
+
+// Select returns the names of the requested and tagged tasks and of the tasks
+// that they directly or indirectly depend on, less the skipped tasks.
+// Requesting no tasks or tags selects every task.
+func (c *Config) Select(s *Selection) (map[string]bool, error) {
+	for _, name := range append(append([]string{}, s.Tasks...), s.Skip...) {
+		if c.Task(name) == nil {
+			return nil, fmt.Errorf("Unknown task: %s", name)
+		}
+	}
+
+	for _, tag := range append(append([]string{}, s.Tags...), s.SkipTags...) {
+		if !c.tags[tag] {
+			return nil, fmt.Errorf("Unknown tag: %s", tag)
+		}
+	}
+
+	selected := make(map[string]bool)
+
+	requests := append([]string{}, s.Tasks...)
+	for _, t := range c.Tasks {
+		if t.HasTag(s.Tags...) {
+			requests = append(requests, t.Name)
+		}
+	}
+
+	if len(s.Tasks) == 0 && len(s.Tags) == 0 {
+		for _, t := range c.Tasks {
+			selected[t.Name] = true
+		}
+	}
+
+	for _, request := range requests {
+		selected[request] = true
+
+		for _, t := range c.TransitiveDependencies(request) {
+			selected[t.Name] = true
+		}
+	}
+
+	for _, skip := range s.Skip {
+		delete(selected, skip)
+	}
+
+	for _, t := range c.Tasks {
+		if t.HasTag(s.SkipTags...) {
+			delete(selected, t.Name)
+		}
+	}
+
+	return selected, nil
+}
+
+// Task returns the named task, or nil if the config does not contain it
+func (c *Config) Task(name string) *task.Task {
+	for _, t := range c.Tasks {
+		if t.Name == name {
+			return t
+		}
+	}
+
+	return nil
+}
+
 func newConfig() *Config {
 	return &Config{}
 }
 
-func resolveDependencies(tasks map[string]*task.Task) ([]*task.Task, error) {
-	var t []*task.Task
+// resolveDependencies orders the tasks into layers, where each task depends
+// only on tasks in earlier layers
+func resolveDependencies(tasks map[string]*task.Task) ([][]*task.Task, error) {
+	if errs := checkDependencies(dependencyGraph(tasks)); len(errs) != 0 {
+		return nil, errs[0]
+	}
+
+	var layers [][]*task.Task
 	taskDependencies := make(map[string]mapset.Set)
 
 	for taskName, task := range tasks {
@@ -86,22 +412,40 @@ func resolveDependencies(tasks map[string]*task.Task) ([]*task.Task, error) {
 			return nil, fmt.Errorf("Circular dependency found.")
 		}
 
+		// sort the ready set so that tasks are provisioned in a stable order
+		var names []string
 		for name := range readySet.Iter() {
-			delete(taskDependencies, name.(string))
-			t = append(t, tasks[name.(string)])
+			names = append(names, name.(string))
 		}
 
+		sort.Strings(names)
+
+		var layer []*task.Task
+		for _, name := range names {
+			delete(taskDependencies, name)
+			layer = append(layer, tasks[name])
+		}
+
+		layers = append(layers, layer)
+
 		for name, deps := range taskDependencies {
 			diff := deps.Difference(readySet)
 			taskDependencies[name] = diff
 		}
 	}
 
-	return t, nil
+	return layers, nil
 }
 
-func loadConfig(file string) (*Config, error) {
-	bytes, err := ioutil.ReadFile(file)
+func loadConfig(machine string) (*Config, error) {
+	chain := &inheritance{}
+
+	doc, err := loadDocument(workingTree{}, machine, machine, "", chain)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := yaml.Marshal(doc)
 	if err != nil {
 		return nil, err
 	}
@@ -113,6 +457,8 @@ func loadConfig(file string) (*Config, error) {
 		return nil, err
 	}
 
+	cfg.extensions = chain.extensions
+
 	return cfg, nil
 }
 
@@ -130,7 +476,7 @@ func AcquireConfig(machine string) (*Config, error) {
 		return nil, err
 	}
 
-	cfg, err := loadConfig(file)
+	cfg, err := loadConfig(machine)
 	if err != nil {
 		return nil, err
 	}
@@ -140,5 +486,62 @@ func AcquireConfig(machine string) (*Config, error) {
 
 	cfg.Machine = machine
 
+	err = cfg.prepareLinks()
+	if err != nil {
+		return nil, err
+	}
+
 	return cfg, nil
 }
+
+// prepareLinks attaches the data that template links are rendered with, and
+// rehashes the tasks and the machine to account for the contents of the
+// targets that are placed at their destinations
+func (c *Config) prepareLinks() error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	env := make(map[string]string)
+	for variable, value := range c.Environment {
+		env[variable] = os.ExpandEnv(value)
+	}
+
+	data := &link.TemplateData{
+		Machine:  c.Machine,
+		Hostname: hostname,
+		OS:       runtime.GOOS,
+		Env:      env,
+	}
+
+	tasks := make(map[string]*task.Task)
+	for _, t := range c.Tasks {
+		tasks[t.Name] = t
+
+		prepared := false
+		for _, l := range t.Links {
+			if !l.Placed() {
+				continue
+			}
+
+			err = l.Prepare(data, c.readTarget)
+			if err != nil {
+				return fmt.Errorf("Failed to prepare link in task %s: %s", t.Name, err)
+			}
+
+			prepared = true
+		}
+
+		if prepared {
+			err = t.Rehash()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	c.SHA1, err = hash(c.Environment, tasks)
+
+	return err
+}
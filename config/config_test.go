@@ -0,0 +1,90 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const orderedMachine = `
+tasks:
+  zsh:
+    dependencies: [git, brew]
+    commands: [echo zsh]
+  git:
+    dependencies: [brew]
+    commands: [echo git]
+  brew:
+    commands: [echo brew]
+  vim:
+    dependencies: [git]
+    commands: [echo vim]
+  tmux:
+    dependencies: [brew]
+    commands: [echo tmux]
+  fonts:
+    commands: [echo fonts]
+`
+
+func layerNames(c *Config) [][]string {
+	var names [][]string
+	for _, layer := range c.Layers {
+		var layerNames []string
+		for _, t := range layer {
+			layerNames = append(layerNames, t.Name)
+		}
+
+		names = append(names, layerNames)
+	}
+
+	return names
+}
+
+func TestResolveDependenciesLayerOrder(t *testing.T) {
+	expected := [][]string{
+		{"brew", "fonts"},
+		{"git", "tmux"},
+		{"vim", "zsh"},
+	}
+
+	for i := 0; i < 20; i++ {
+		cfg := newConfig()
+
+		err := yaml.Unmarshal([]byte(orderedMachine), &cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if layers := layerNames(cfg); !reflect.DeepEqual(layers, expected) {
+			t.Fatalf("load %d: expected layers %v, got %v", i, expected, layers)
+		}
+
+		var order []string
+		for _, task := range cfg.Tasks {
+			order = append(order, task.Name)
+		}
+
+		if expected := []string{"brew", "fonts", "git", "tmux", "vim", "zsh"}; !reflect.DeepEqual(order, expected) {
+			t.Fatalf("load %d: expected tasks %v, got %v", i, expected, order)
+		}
+	}
+}
+
+func TestResolveDependenciesCircular(t *testing.T) {
+	cfg := newConfig()
+
+	err := yaml.Unmarshal([]byte(`
+tasks:
+  a:
+    dependencies: [b]
+    commands: [echo a]
+  b:
+    dependencies: [a]
+    commands: [echo b]
+`), &cfg)
+
+	if _, ok := err.(*CircularDependencyError); !ok {
+		t.Fatalf("expected a circular dependency error, got %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/autonomy/alterant/task"
+)
+
+// UnknownDependencyError is returned when a task depends on a task that does
+// not exist
+type UnknownDependencyError struct {
+	Task       string
+	Dependency string
+}
+
+func (e *UnknownDependencyError) Error() string {
+	return fmt.Sprintf("Unknown dependency: %s depends on %s, which does not exist", e.Task, e.Dependency)
+}
+
+// CircularDependencyError is returned when tasks depend on each other. The
+// cycle begins and ends with the same task.
+type CircularDependencyError struct {
+	Cycle []string
+}
+
+func (e *CircularDependencyError) Error() string {
+	return fmt.Sprintf("Circular dependency found: %s", strings.Join(e.Cycle, " -> "))
+}
+
+// dependencyGraph maps each task to the names of the tasks it depends on
+func dependencyGraph(tasks map[string]*task.Task) map[string][]string {
+	graph := make(map[string][]string)
+
+	for name, task := range tasks {
+		graph[name] = task.Dependencies
+	}
+
+	return graph
+}
+
+func sortedNames(graph map[string][]string) []string {
+	var names []string
+	for name := range graph {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// canonicalCycle rotates a cycle to begin with its smallest task name, so
+// that the same cycle found from different tasks is only reported once
+func canonicalCycle(cycle []string) string {
+	nodes := cycle[:len(cycle)-1]
+
+	start := 0
+	for i, name := range nodes {
+		if name < nodes[start] {
+			start = i
+		}
+	}
+
+	rotated := append(append([]string{}, nodes[start:]...), nodes[:start]...)
+
+	return strings.Join(rotated, " -> ")
+}
+
+// checkDependencies returns every unknown dependency and every distinct
+// dependency cycle of a dependency graph
+func checkDependencies(graph map[string][]string) []error {
+	var errs []error
+
+	names := sortedNames(graph)
+
+	for _, name := range names {
+		for _, dep := range graph[name] {
+			if _, ok := graph[dep]; !ok {
+				errs = append(errs, &UnknownDependencyError{Task: name, Dependency: dep})
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make(map[string]int)
+	reported := make(map[string]bool)
+	var stack []string
+
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = visiting
+		stack = append(stack, name)
+
+		for _, dep := range graph[name] {
+			if _, ok := graph[dep]; !ok {
+				continue
+			}
+
+			switch state[dep] {
+			case unvisited:
+				visit(dep)
+			case visiting:
+				// the dependency is on the stack, so the path from it to the
+				// current task forms a cycle
+				var cycle []string
+				for i := len(stack) - 1; i >= 0; i-- {
+					if stack[i] == dep {
+						cycle = append(cycle, stack[i:]...)
+						break
+					}
+				}
+
+				cycle = append(cycle, dep)
+
+				key := canonicalCycle(cycle)
+				if !reported[key] {
+					reported[key] = true
+					errs = append(errs, &CircularDependencyError{Cycle: cycle})
+				}
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+	}
+
+	for _, name := range names {
+		if state[name] == unvisited {
+			visit(name)
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,214 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/autonomy/alterant/repo"
+)
+
+// branch reads files from the branch of another machine
+type branch struct {
+	*repo.Branch
+}
+
+func (b branch) Name(file string) string { return b.Machine + ":" + file }
+
+// extension is a machine that is extended, along with the directory that its
+// files are exported to
+type extension struct {
+	branch *repo.Branch
+	dir    string
+}
+
+// inheritance records the chain of machines that a machine extends
+type inheritance struct {
+	machines   []string
+	extensions []*extension
+}
+
+// extendsOf returns the machine that a machine file extends, if any
+func extendsOf(s *source) string {
+	var aux struct {
+		Extends string `yaml:"extends"`
+	}
+
+	// errors are reported when the rest of the file is unmarshalled
+	yaml.Unmarshal(s.bytes, &aux)
+
+	return aux.Extends
+}
+
+// extendsDir returns where the files of an extended machine are exported to,
+// as links cannot point into a branch that is not checked out
+func extendsDir(machine string, parent string) string {
+	return path.Join(os.Getenv("ALTERANT_HOME"), ".extends", machine, parent)
+}
+
+// loadDocument reads a machine file and the files it includes, layered on top
+// of the machine that it extends. The files of an extended machine are read
+// from its branch, and its targets point into dir, which its files are exported
+// to when the machine is provisioned. chain holds the machines that have been
+// read so far, in order to detect circular inheritance.
+func loadDocument(fs fileSystem, name string, machine string, dir string, chain *inheritance) (yaml.MapSlice, error) {
+	sources, err := readSources(fs, name+".yaml")
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := merge(sources)
+	if err != nil {
+		return nil, err
+	}
+
+	if dir != "" {
+		err = rebaseTargets(doc, dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	chain.machines = append(chain.machines, name)
+
+	parent, err := loadParent(sources[0], machine, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	if parent == nil {
+		return doc, nil
+	}
+
+	return layer(parent, doc), nil
+}
+
+// loadParent reads the machine that a machine file extends from its branch,
+// and records it in the chain so that its files can be exported. It returns nil
+// if the machine file does not extend another machine.
+func loadParent(s *source, machine string, chain *inheritance) (yaml.MapSlice, error) {
+	name := extendsOf(s)
+	if name == "" {
+		return nil, nil
+	}
+
+	for _, e := range chain.machines {
+		if e == name {
+			return nil, fmt.Errorf("Circular extends: %s -> %s", strings.Join(chain.machines, " -> "), name)
+		}
+	}
+
+	b, err := repo.OpenBranch(name)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := extendsDir(machine, name)
+
+	chain.extensions = append(chain.extensions, &extension{branch: b, dir: dir})
+
+	return loadDocument(branch{b}, name, machine, dir, chain)
+}
+
+// ExportExtended exports the files of the machines that the machine extends,
+// so that links can be created to them. It is only called when provisioning,
+// as the exported files are the targets of provisioned links.
+func (c *Config) ExportExtended() error {
+	for _, e := range c.extensions {
+		err := e.branch.Export(e.dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readTarget reads the target of a link. The targets of an extended machine
+// are read from its branch, as they may not have been exported yet.
+func (c *Config) readTarget(file string) ([]byte, error) {
+	for _, e := range c.extensions {
+		if strings.HasPrefix(file, e.dir+"/") {
+			return e.branch.ReadFile(strings.TrimPrefix(file, e.dir+"/"))
+		}
+	}
+
+	return ioutil.ReadFile(file)
+}
+
+// rebaseTargets points the link targets of a document read from a branch at
+// the directory its files were exported to. Targets are relative to the cwd, so
+// the directory is made relative to it as well.
+func rebaseTargets(doc yaml.MapSlice, dir string) error {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(cwd, dir)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range entries(valueOf(doc, "tasks")) {
+		task, ok := t.Value.(yaml.MapSlice)
+		if !ok {
+			continue
+		}
+
+		links, ok := valueOf(task, "links").([]interface{})
+		if !ok {
+			continue
+		}
+
+		for _, l := range links {
+			link, ok := l.(yaml.MapSlice)
+			if !ok {
+				continue
+			}
+
+			for i := range link {
+				target, ok := link[i].Value.(string)
+				if fmt.Sprint(link[i].Key) == "target" && ok && !path.IsAbs(target) {
+					link[i].Value = path.Join(rel, target)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// layer overrides the parent document with the machine's document. Tasks and
+// environment variables are overridden one by one, any other key as a whole.
+func layer(parent yaml.MapSlice, doc yaml.MapSlice) yaml.MapSlice {
+	override := func(base yaml.MapSlice, overrides yaml.MapSlice) yaml.MapSlice {
+		var layered yaml.MapSlice
+		for _, item := range base {
+			if indexOf(overrides, fmt.Sprint(item.Key)) == -1 {
+				layered = append(layered, item)
+			}
+		}
+
+		return append(layered, overrides...)
+	}
+
+	var layered yaml.MapSlice
+	for _, item := range override(parent, doc) {
+		switch fmt.Sprint(item.Key) {
+		case "extends", "environment", "tasks":
+		default:
+			layered = append(layered, item)
+		}
+	}
+
+	return append(layered,
+		yaml.MapItem{Key: "environment", Value: override(entries(valueOf(parent, "environment")), entries(valueOf(doc, "environment")))},
+		yaml.MapItem{Key: "tasks", Value: override(entries(valueOf(parent, "tasks")), entries(valueOf(doc, "tasks")))},
+	)
+}
@@ -0,0 +1,224 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/autonomy/alterant/condition"
+)
+
+// fileSystem is where the files of a machine's config are read from
+type fileSystem interface {
+	ReadFile(name string) ([]byte, error)
+	Glob(pattern string) ([]string, error)
+	// Name describes a file in error messages
+	Name(file string) string
+}
+
+// workingTree reads files from the checked out machine in the cwd
+type workingTree struct{}
+
+func (workingTree) ReadFile(name string) ([]byte, error)  { return ioutil.ReadFile(name) }
+func (workingTree) Glob(pattern string) ([]string, error) { return filepath.Glob(pattern) }
+func (workingTree) Name(file string) string               { return file }
+
+// source is a file that contributes to a machine's config
+type source struct {
+	file  string
+	bytes []byte
+	raw   yaml.MapSlice
+}
+
+// valueOf returns the value of a key of a mapping, or nil
+func valueOf(m yaml.MapSlice, key string) interface{} {
+	for _, item := range m {
+		if fmt.Sprint(item.Key) == key {
+			return item.Value
+		}
+	}
+
+	return nil
+}
+
+// includes returns the files included by the source. Patterns are relative to
+// the root of the repository and may contain globs.
+func (s *source) includes(fs fileSystem) ([]string, error) {
+	var aux struct {
+		Include condition.List `yaml:"include"`
+	}
+
+	err := yaml.Unmarshal(s.bytes, &aux)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, pattern := range aux.Include {
+		matches, err := fs.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid include in %s: %s", s.file, err)
+		}
+
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("Include in %s matched no files: %s", s.file, pattern)
+		}
+
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+
+	return files, nil
+}
+
+func readSource(fs fileSystem, file string) (*source, error) {
+	b, err := fs.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &source{file: fs.Name(file), bytes: b}
+
+	err = yaml.Unmarshal(b, &s.raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", s.file, err)
+	}
+
+	return s, nil
+}
+
+// readSources reads the machine file followed by every file that it includes,
+// directly or indirectly. A file that is included more than once is only read
+// the first time.
+func readSources(fs fileSystem, file string) ([]*source, error) {
+	var sources []*source
+	seen := make(map[string]bool)
+
+	var read func(file string) error
+	read = func(file string) error {
+		if seen[filepath.Clean(file)] {
+			return nil
+		}
+
+		seen[filepath.Clean(file)] = true
+
+		s, err := readSource(fs, file)
+		if err != nil {
+			return err
+		}
+
+		sources = append(sources, s)
+
+		files, err := s.includes(fs)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			err = read(f)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	err := read(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return sources, nil
+}
+
+// merge merges the environment and tasks of the included files into the
+// machine file, which is the first source. The environment of the machine file
+// takes precedence, whereas a task may only be declared once.
+func merge(sources []*source) (yaml.MapSlice, error) {
+	environment := yaml.MapSlice{}
+	environmentFiles := make(map[string]string)
+	tasks := yaml.MapSlice{}
+	taskFiles := make(map[string]string)
+
+	// the machine file is merged last, so that its environment takes precedence
+	ordered := append(append([]*source{}, sources[1:]...), sources[0])
+
+	for _, s := range ordered {
+		// variables are decoded as strings, so that values such as 1.10 are
+		// not reformatted by the merge
+		var aux struct {
+			Environment map[string]string `yaml:"environment"`
+		}
+
+		err := yaml.Unmarshal(s.bytes, &aux)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", s.file, err)
+		}
+
+		var variables []string
+		for variable := range aux.Environment {
+			variables = append(variables, variable)
+		}
+
+		sort.Strings(variables)
+
+		for _, variable := range variables {
+			value := aux.Environment[variable]
+
+			if other, ok := environmentFiles[variable]; ok {
+				i := indexOf(environment, variable)
+
+				if s != sources[0] && environment[i].Value != value {
+					return nil, fmt.Errorf("Conflicting environment variable %s in %s and %s", variable, other, s.file)
+				}
+
+				environment[i].Value = value
+				continue
+			}
+
+			environmentFiles[variable] = s.file
+			environment = append(environment, yaml.MapItem{Key: variable, Value: value})
+		}
+
+		for _, item := range entries(valueOf(s.raw, "tasks")) {
+			name := fmt.Sprint(item.Key)
+
+			if other, ok := taskFiles[name]; ok {
+				return nil, fmt.Errorf("Duplicate task %s in %s and %s", name, other, s.file)
+			}
+
+			taskFiles[name] = s.file
+			tasks = append(tasks, yaml.MapItem{Key: name, Value: item.Value})
+		}
+	}
+
+	var merged yaml.MapSlice
+	for _, item := range sources[0].raw {
+		switch fmt.Sprint(item.Key) {
+		case "include", "environment", "tasks":
+		default:
+			merged = append(merged, item)
+		}
+	}
+
+	merged = append(merged,
+		yaml.MapItem{Key: "environment", Value: environment},
+		yaml.MapItem{Key: "tasks", Value: tasks},
+	)
+
+	return merged, nil
+}
+
+func indexOf(items yaml.MapSlice, key string) int {
+	for i, item := range items {
+		if fmt.Sprint(item.Key) == key {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,592 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/autonomy/alterant/command"
+	"github.com/autonomy/alterant/condition"
+	"github.com/autonomy/alterant/link"
+)
+
+// ValidationError describes a problem with a machine's config and where it
+// was found
+type ValidationError struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.File, e.Message)
+	}
+
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+}
+
+// schema describes the keys that are allowed in a section of `machine.yaml`.
+// A nil schema allows any value.
+type schema struct {
+	// keys are the fixed keys of a mapping
+	keys map[string]*schema
+	// values is the schema of every value of a mapping with arbitrary keys
+	values *schema
+	// items is the schema of every item of a sequence
+	items *schema
+}
+
+var conditionSchema = &schema{
+	keys: map[string]*schema{
+		"os":         nil,
+		"hostname":   nil,
+		"executable": nil,
+		"env":        nil,
+	},
+}
+
+var linkSchema = &schema{
+	keys: map[string]*schema{
+		"target":      nil,
+		"destination": nil,
+		"encrypted":   nil,
+		"template":    nil,
+		"mode":        nil,
+		"permissions": nil,
+		"owner":       nil,
+		"group":       nil,
+		"when":        conditionSchema,
+	},
+}
+
+// commandSchema applies to commands declared as a mapping rather than a string
+var commandSchema = &schema{
+	keys: map[string]*schema{
+		"run":  nil,
+		"when": conditionSchema,
+	},
+}
+
+var taskSchema = &schema{
+	keys: map[string]*schema{
+		"dependencies": nil,
+		"links":        {items: linkSchema},
+		"commands":     {items: commandSchema},
+		"teardown":     {items: commandSchema},
+		"tags":         nil,
+		"when":         conditionSchema,
+	},
+}
+
+// includeSchema applies to the files included by a machine
+var includeSchema = &schema{
+	keys: map[string]*schema{
+		"include":     nil,
+		"environment": nil,
+		"tasks":       {values: taskSchema},
+	},
+}
+
+var machineSchema = &schema{
+	keys: map[string]*schema{
+		"extends":     nil,
+		"include":     nil,
+		"environment": nil,
+		"tasks":       {values: taskSchema},
+		"update_strategy": {
+			keys: map[string]*schema{
+				"mode":      nil,
+				"propagate": nil,
+				"tasks": {
+					values: &schema{
+						keys: map[string]*schema{"always_run": nil},
+					},
+				},
+			},
+		},
+	},
+}
+
+// validator collects the problems found in a single file
+type validator struct {
+	file  string
+	lines []string
+	errs  []error
+}
+
+func (v *validator) report(path []interface{}, format string, args ...interface{}) {
+	v.errs = append(v.errs, &ValidationError{
+		File:    v.file,
+		Line:    v.line(path),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// entries returns the items of a mapping in the order they were declared
+func entries(value interface{}) yaml.MapSlice {
+	switch m := value.(type) {
+	case yaml.MapSlice:
+		return m
+	case map[interface{}]interface{}:
+		keys := make(map[string]interface{})
+		var names []string
+		for k := range m {
+			name := fmt.Sprint(k)
+			keys[name] = k
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		var items yaml.MapSlice
+		for _, name := range names {
+			items = append(items, yaml.MapItem{Key: keys[name], Value: m[keys[name]]})
+		}
+
+		return items
+	}
+
+	return nil
+}
+
+// checkKeys reports every key of value that is not allowed by s
+func (v *validator) checkKeys(value interface{}, s *schema, path []interface{}) {
+	if s == nil {
+		return
+	}
+
+	if s.items != nil {
+		if items, ok := value.([]interface{}); ok {
+			for i, item := range items {
+				v.checkKeys(item, s.items, append(path, i))
+			}
+		}
+
+		return
+	}
+
+	for _, item := range entries(value) {
+		key := fmt.Sprint(item.Key)
+		keyPath := append(append([]interface{}{}, path...), key)
+
+		if s.values != nil {
+			v.checkKeys(item.Value, s.values, keyPath)
+			continue
+		}
+
+		child, ok := s.keys[key]
+		if !ok {
+			v.report(keyPath, "Unknown key: %s", formatPath(keyPath))
+			continue
+		}
+
+		v.checkKeys(item.Value, child, keyPath)
+	}
+}
+
+// formatPath formats a key path as tasks.vim.links[0].target
+func formatPath(path []interface{}) string {
+	var s string
+	for _, p := range path {
+		switch p := p.(type) {
+		case int:
+			s += fmt.Sprintf("[%d]", p)
+		default:
+			if s != "" {
+				s += "."
+			}
+
+			s += fmt.Sprint(p)
+		}
+	}
+
+	return s
+}
+
+// indentation returns the column of the first character of a line, and the
+// column of its key once any sequence indicators have been stripped
+func indentation(line string) (int, int, bool) {
+	trimmed := strings.TrimLeft(line, " ")
+	col := len(line) - len(trimmed)
+	key := col
+	dash := false
+
+	for strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+		dash = true
+		stripped := strings.TrimLeft(strings.TrimPrefix(trimmed, "-"), " ")
+		key += len(trimmed) - len(stripped)
+		trimmed = stripped
+	}
+
+	return col, key, dash
+}
+
+func blank(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "" || strings.HasPrefix(trimmed, "#")
+}
+
+// line locates the line of a key path, such as tasks.vim.links[0].target, by
+// following the indentation of the file. It returns the line of the deepest
+// key that could be found, or 0 if none could.
+func (v *validator) line(path []interface{}) int {
+	found := 0
+	start := 0
+	scope := -1
+	inItem := false
+
+	for _, p := range path {
+		i, col, ok := v.find(p, start, scope, inItem)
+		if !ok {
+			break
+		}
+
+		found = i + 1
+		scope = col
+		_, inItem = p.(int)
+
+		if inItem {
+			start = i
+		} else {
+			start = i + 1
+		}
+	}
+
+	return found
+}
+
+// find returns the line and column of a key or sequence item within the block
+// that begins at start and is indented further than scope
+func (v *validator) find(p interface{}, start, scope int, inItem bool) (int, int, bool) {
+	childCol := -1
+	index := 0
+
+	for i := start; i < len(v.lines); i++ {
+		line := v.lines[i]
+		if blank(line) {
+			continue
+		}
+
+		col, keyCol, dash := indentation(line)
+
+		// the first line of a sequence item begins at the item's own column
+		if !(inItem && i == start) {
+			if col < scope || (col == scope && !(dash && !inItem)) {
+				break
+			}
+		}
+
+		switch p := p.(type) {
+		case int:
+			if !dash {
+				continue
+			}
+
+			if childCol == -1 {
+				childCol = col
+			}
+
+			if col != childCol {
+				continue
+			}
+
+			if index == p {
+				return i, col, true
+			}
+
+			index++
+		case string:
+			// the keys of an item may begin on the line after its indicator
+			if strings.TrimSpace(line[keyCol:]) == "" {
+				continue
+			}
+
+			if childCol == -1 {
+				childCol = keyCol
+			}
+
+			if keyCol != childCol {
+				continue
+			}
+
+			key := strings.TrimLeft(line[keyCol:], " ")
+			key = strings.Trim(strings.SplitN(key, ":", 2)[0], `"'`)
+
+			if key == p {
+				return i, keyCol, true
+			}
+		}
+	}
+
+	return 0, 0, false
+}
+
+// checkEmptyPaths reports the link targets and destinations that are declared
+// but empty, and returns true if it found any
+func (v *validator) checkEmptyPaths(raw yaml.MapSlice) bool {
+	found := false
+
+	for _, t := range entries(valueOf(raw, "tasks")) {
+		name := fmt.Sprint(t.Key)
+		links, _ := valueOf(entries(t.Value), "links").([]interface{})
+
+		for i, l := range links {
+			for _, key := range []string{"target", "destination"} {
+				value, ok := valueOf(entries(l), key).(string)
+				if !ok || os.ExpandEnv(value) != "" {
+					continue
+				}
+
+				v.report([]interface{}{"tasks", name, "links", i, key}, "Link in %s has an empty %s", name, key)
+				found = true
+			}
+		}
+	}
+
+	return found
+}
+
+// validationTask is a task as declared, before duplicate links are removed, so
+// that each link can be traced back to its position in the file
+type validationTask struct {
+	Dependencies []string             `yaml:"dependencies"`
+	Links        []*link.Link         `yaml:"links"`
+	Commands     []*command.Command   `yaml:"commands"`
+	Teardown     []*command.Command   `yaml:"teardown"`
+	When         *condition.Condition `yaml:"when"`
+}
+
+// Validate reads the machine's config and the files it includes from the
+// cwd, and returns every problem found rather than stopping at the first one
+// like AcquireConfig
+func Validate(machine string) []error {
+	file := machine + ".yaml"
+
+	sources, err := readSources(workingTree{}, file)
+	if err != nil {
+		return []error{err}
+	}
+
+	parent, err := loadParent(sources[0], machine, &inheritance{machines: []string{machine}})
+	if err != nil {
+		return []error{&ValidationError{File: file, Message: err.Error()}}
+	}
+
+	// required by the custom unmarshalling of SymlinkTarget and SymlinkDestination
+	os.Setenv("MACHINE", machine)
+
+	var validators []*validator
+	declared := make(map[string]*validator)
+	tasks := make(map[string]*validationTask)
+	destinations := make(map[string][]*declaredLink)
+
+	for i, s := range sources {
+		v := &validator{
+			file:  s.file,
+			lines: strings.Split(string(s.bytes), "\n"),
+		}
+
+		validators = append(validators, v)
+
+		if i == 0 {
+			v.checkKeys(s.raw, machineSchema, nil)
+		} else {
+			v.checkKeys(s.raw, includeSchema, nil)
+		}
+
+		// empty paths fail to unmarshal, so they are located in the raw yaml
+		empty := v.checkEmptyPaths(s.raw)
+
+		var aux struct {
+			Tasks map[string]*validationTask `yaml:"tasks"`
+		}
+
+		err = yaml.Unmarshal(s.bytes, &aux)
+		if err != nil {
+			if !empty {
+				v.errs = append(v.errs, &ValidationError{File: s.file, Message: err.Error()})
+			}
+
+			continue
+		}
+
+		var names []string
+		for name := range aux.Tasks {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			t := aux.Tasks[name]
+			path := []interface{}{"tasks", name}
+
+			if other, ok := declared[name]; ok {
+				v.report(path, "Duplicate task: %s is also declared in %s", name, other.file)
+				continue
+			}
+
+			declared[name] = v
+			tasks[name] = t
+
+			if t == nil || (len(t.Links) == 0 && len(t.Commands) == 0 && len(t.Teardown) == 0) {
+				v.report(path, "Empty task: %s has no links or commands", name)
+				continue
+			}
+
+			for i, l := range t.Links {
+				linkPath := append(append([]interface{}{}, path...), "links", i)
+				v.checkLink(name, t.When, l, linkPath, destinations)
+			}
+		}
+	}
+
+	// tasks that are inherited, and not overridden, are only checked for their
+	// dependencies, as they are validated with the machine that declares them
+	if parent != nil {
+		var aux struct {
+			Tasks map[string]*validationTask `yaml:"tasks"`
+		}
+
+		b, err := yaml.Marshal(parent)
+		if err == nil {
+			err = yaml.Unmarshal(b, &aux)
+		}
+
+		if err != nil {
+			return append(validators[0].errs, &ValidationError{File: file, Message: err.Error()})
+		}
+
+		for name, t := range aux.Tasks {
+			if _, ok := tasks[name]; !ok {
+				tasks[name] = t
+			}
+		}
+	}
+
+	// dependencies may refer to tasks in any of the files
+	dependencies := make(map[string][]string)
+	for name, t := range tasks {
+		if t != nil {
+			dependencies[name] = t.Dependencies
+		} else {
+			dependencies[name] = nil
+		}
+	}
+
+	// problems with inherited tasks are reported against the machine file
+	reporter := func(name string) *validator {
+		if v, ok := declared[name]; ok {
+			return v
+		}
+
+		return validators[0]
+	}
+
+	for _, err := range checkDependencies(dependencies) {
+		switch err := err.(type) {
+		case *UnknownDependencyError:
+			reporter(err.Task).report([]interface{}{"tasks", err.Task, "dependencies"}, "%s", err)
+		case *CircularDependencyError:
+			reporter(err.Cycle[0]).report([]interface{}{"tasks", err.Cycle[0], "dependencies"}, "%s", err)
+		}
+	}
+
+	var errs []error
+	for _, v := range validators {
+		errs = append(errs, v.errs...)
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+
+	// anything that was missed above, such as an invalid update strategy, is
+	// still caught when the config is loaded
+	_, err = AcquireConfig(machine)
+	if err != nil {
+		return []error{&ValidationError{File: file, Message: err.Error()}}
+	}
+
+	return nil
+}
+
+// placement names how a link places its target
+func placement(l *link.Link) string {
+	if l.Template {
+		return "template"
+	}
+
+	return l.Mode
+}
+
+// declaredLink records a task that declares a destination, and the condition
+// of the task
+type declaredLink struct {
+	task string
+	when *condition.Condition
+	link *link.Link
+}
+
+// excludes returns true if the links cannot both be created on the same host,
+// as the conditions of the links or their tasks cannot both be met
+func (d *declaredLink) excludes(other *declaredLink) bool {
+	for _, a := range []*condition.Condition{d.when, d.link.When} {
+		for _, b := range []*condition.Condition{other.when, other.link.When} {
+			if a.Excludes(b) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (v *validator) checkLink(name string, when *condition.Condition, l *link.Link, path []interface{}, destinations map[string][]*declaredLink) {
+	if l.Target == "" {
+		v.report(path, "Link in %s is missing a target", name)
+	}
+
+	if l.Destination == "" {
+		v.report(path, "Link in %s is missing a destination", name)
+	}
+
+	if l.Target != "" {
+		target := string(l.Target)
+
+		if l.Encrypted {
+			if _, err := os.Stat(target + ".encrypted"); err != nil {
+				v.report(append(path, "target"), "Encrypted target does not exist: %s.encrypted", target)
+			}
+		} else if stat, err := os.Lstat(target); err != nil {
+			v.report(append(path, "target"), "Target does not exist: %s", target)
+		} else if l.Placed() && !stat.Mode().IsRegular() {
+			v.report(append(path, "target"), "Target of a %s link is not a file: %s", placement(l), target)
+		}
+	}
+
+	if l.Destination != "" {
+		destination := string(l.Destination)
+
+		declared := &declaredLink{task: name, when: when, link: l}
+
+		for _, other := range destinations[destination] {
+			// identical links within a task are ignored when the task is loaded
+			if other.task == name && other.link.SHA1 == l.SHA1 {
+				return
+			}
+
+			// links for different hosts may share a destination
+			if !declared.excludes(other) {
+				v.report(append(path, "destination"), "Duplicate destination: %s is also linked by %s", destination, other.task)
+				return
+			}
+		}
+
+		destinations[destination] = append(destinations[destination], declared)
+	}
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// validateMachine writes the machine file to a temporary directory and
+// validates it from there
+func validateMachine(t *testing.T, machine string) []string {
+	dir, err := ioutil.TempDir("", "alterant")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Chdir(cwd)
+
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(path.Join(dir, "test.yaml"), []byte(machine), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var errs []string
+	for _, err := range Validate("test") {
+		errs = append(errs, err.Error())
+	}
+
+	return errs
+}
+
+func TestValidateEmptyLinkPaths(t *testing.T) {
+	errs := validateMachine(t, `
+tasks:
+  dotfiles:
+    links:
+      - target: ""
+        destination: ""
+`)
+
+	expected := []string{
+		"test.yaml:5: Link in dotfiles has an empty target",
+		"test.yaml:6: Link in dotfiles has an empty destination",
+	}
+
+	if !reflect.DeepEqual(errs, expected) {
+		t.Fatalf("expected %v, got %v", expected, errs)
+	}
+}
+
+func TestValidateConditionalDuplicateDestinations(t *testing.T) {
+	errs := validateMachine(t, `
+tasks:
+  linux:
+    when:
+      os: linux
+    links:
+      - target: test.yaml
+        destination: .machine
+  darwin:
+    when:
+      os: darwin
+    links:
+      - target: test.yaml
+        destination: .machine
+  work:
+    links:
+      - target: test.yaml
+        destination: .profile
+        when:
+          env: PROFILE=work
+      - target: test.yaml
+        destination: .profile
+        mode: copy
+        when:
+          env: PROFILE=home
+`)
+
+	if len(errs) != 0 {
+		t.Fatalf("expected no errors, got %v", errs)
+	}
+
+	errs = validateMachine(t, `
+tasks:
+  linux:
+    when:
+      os: linux
+    links:
+      - target: test.yaml
+        destination: .machine
+  laptop:
+    when:
+      hostname: laptop
+    links:
+      - target: test.yaml
+        destination: .machine
+`)
+
+	expected := []string{"test.yaml:8: Duplicate destination: " + path.Join(os.Getenv("HOME"), ".machine") + " is also linked by laptop"}
+
+	if !reflect.DeepEqual(errs, expected) {
+		t.Fatalf("expected %v, got %v", expected, errs)
+	}
+}
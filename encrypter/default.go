@@ -49,8 +49,8 @@ func isFile(file string) (bool, error) {
 	return true, nil
 }
 
-func writeToFile(data, file string) {
-	ioutil.WriteFile(file, []byte(data), 0666)
+func writeToFile(data, file string, perm os.FileMode) {
+	ioutil.WriteFile(file, []byte(data), perm)
 }
 
 func readFromFile(file string) ([]byte, error) {
@@ -259,7 +259,7 @@ func encryptFile(file string, to *openpgp.EntityList, signed *openpgp.Entity, pg
 	encoded := base64.StdEncoding.EncodeToString(bytes)
 
 	// write the encoded/encypted data to disk
-	writeToFile(encoded, file+".encrypted")
+	writeToFile(encoded, file+".encrypted", 0666)
 
 	return nil
 }
@@ -349,7 +349,8 @@ func decryptFile(file string, to *openpgp.EntityList, pgpCfg *packet.Config) err
 	// write the decoded/decypted data to disk
 	file = strings.TrimSuffix(file, filepath.Ext(file))
 
-	writeToFile(plaintext, file)
+	// decrypted files are secrets, so only the owner may read them
+	writeToFile(plaintext, file, 0600)
 
 	return nil
 }
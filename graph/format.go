@@ -0,0 +1,46 @@
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// WriteJSON writes the graph to w as an indented JSON document
+func (g *Graph) WriteJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s\n", b)
+
+	return err
+}
+
+// WriteDOT writes the graph to w in the Graphviz DOT language. Edges point
+// from a task to the tasks that it depends on.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	fmt.Fprintf(w, "digraph %s {\n", strconv.Quote(g.Machine))
+	fmt.Fprintf(w, "  rankdir=LR;\n")
+	fmt.Fprintf(w, "  node [shape=box];\n")
+
+	for _, t := range g.Tasks {
+		if g.Highlighted && t.Queued {
+			fmt.Fprintf(w, "  %s [style=filled, fillcolor=yellow];\n", strconv.Quote(t.Name))
+		} else {
+			fmt.Fprintf(w, "  %s;\n", strconv.Quote(t.Name))
+		}
+	}
+
+	for _, t := range g.Tasks {
+		for _, dep := range t.Dependencies {
+			fmt.Fprintf(w, "  %s -> %s;\n", strconv.Quote(t.Name), strconv.Quote(dep))
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "}\n")
+
+	return err
+}
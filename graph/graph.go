@@ -0,0 +1,59 @@
+package graph
+
+import (
+	"github.com/autonomy/alterant/config"
+	"github.com/autonomy/alterant/plan"
+)
+
+// Task represents a task and its dependencies in the graph
+type Task struct {
+	Name         string   `json:"name"`
+	Dependencies []string `json:"dependencies"`
+	Tags         []string `json:"tags,omitempty"`
+	Layer        int      `json:"layer"`
+	Queued       bool     `json:"queued,omitempty"`
+	QueuedBy     string   `json:"queued_by,omitempty"`
+}
+
+// Graph represents the dependency graph of a machine's tasks
+type Graph struct {
+	Machine     string  `json:"machine"`
+	Highlighted bool    `json:"highlighted"`
+	Tasks       []*Task `json:"tasks"`
+}
+
+// NewGraph returns the dependency graph of the config, in the order that the
+// tasks are provisioned. If p is not nil, the tasks that it queues are
+// highlighted.
+func NewGraph(cfg *config.Config, p *plan.Plan) *Graph {
+	g := &Graph{
+		Machine:     cfg.Machine,
+		Highlighted: p != nil,
+	}
+
+	for i, layer := range cfg.Layers {
+		for _, t := range layer {
+			gt := &Task{
+				Name:         t.Name,
+				Dependencies: t.Dependencies,
+				Tags:         t.Tags,
+				Layer:        i,
+			}
+
+			if gt.Dependencies == nil {
+				gt.Dependencies = []string{}
+			}
+
+			if p != nil {
+				if pt := p.Task(t.Name); pt != nil {
+					gt.Queued = pt.Queued
+					gt.QueuedBy = pt.QueuedBy
+				}
+			}
+
+			g.Tasks = append(g.Tasks, gt)
+		}
+	}
+
+	return g
+}
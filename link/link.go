@@ -1,11 +1,18 @@
 package link
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
+	"strconv"
+	"text/template"
+	"time"
 
 	"gopkg.in/yaml.v2"
 
+	"github.com/autonomy/alterant/condition"
 	"github.com/autonomy/alterant/hasher"
 )
 
@@ -15,13 +22,45 @@ type SymlinkTarget string
 // SymlinkDestination is a custom type for symlink destinations
 type SymlinkDestination string
 
+// The modes in which a target is placed at its destination
+const (
+	// Symlink links the destination to the target, and is the default
+	Symlink = "symlink"
+	// Copy copies the target to the destination
+	Copy = "copy"
+	// Hardlink hard links the destination to the target
+	Hardlink = "hardlink"
+)
+
 // Link represents a link in the machine yaml
 type Link struct {
 	Target      SymlinkTarget
 	Destination SymlinkDestination
 	Encrypted   bool
+	Template    bool                 `yaml:"template,omitempty"`
+	Mode        string               `yaml:"mode,omitempty"`
+	Permissions os.FileMode          `yaml:"permissions,omitempty"`
+	Owner       string               `yaml:"owner,omitempty"`
+	Group       string               `yaml:"group,omitempty"`
+	Data        *TemplateData        `yaml:"-"`
+	When        *condition.Condition `yaml:"-"`
 	Queued      bool
 	SHA1        string
+	Applied     time.Time `yaml:"-"`
+
+	// Content is the SHA1 of the file placed at the destination by a copy,
+	// hardlink or template. Until the link is placed, it is the SHA1 recorded
+	// when the destination was last placed, if any.
+	Content string `yaml:"-"`
+}
+
+// TemplateData is the data that the target of a template link is rendered
+// with
+type TemplateData struct {
+	Machine  string
+	Hostname string
+	OS       string
+	Env      map[string]string
 }
 
 // UnmarshalYAML implementation for SymlinkTarget
@@ -32,12 +71,18 @@ func (t *SymlinkTarget) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	// an empty target would resolve to the root of the repository
+	target := os.ExpandEnv(aux)
+	if target == "" {
+		return fmt.Errorf("Link target is empty")
+	}
+
 	cwd, err := os.Getwd()
 	if err != nil {
 		return err
 	}
 
-	*t = SymlinkTarget(path.Join(cwd, os.ExpandEnv(aux)))
+	*t = SymlinkTarget(path.Join(cwd, target))
 
 	return nil
 }
@@ -50,9 +95,15 @@ func (t *SymlinkDestination) UnmarshalYAML(unmarshal func(interface{}) error) er
 		return err
 	}
 
+	// an empty destination would resolve to $HOME itself
+	destination := os.ExpandEnv(aux)
+	if destination == "" {
+		return fmt.Errorf("Link destination is empty")
+	}
+
 	home := os.Getenv("HOME")
 
-	*t = SymlinkDestination(path.Join(home, os.ExpandEnv(aux)))
+	*t = SymlinkDestination(path.Join(home, destination))
 
 	return nil
 }
@@ -60,9 +111,15 @@ func (t *SymlinkDestination) UnmarshalYAML(unmarshal func(interface{}) error) er
 // UnmarshalYAML implements the yaml.Unmarshaler interface
 func (l *Link) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var aux struct {
-		Target      SymlinkTarget      `yaml:"target"`
-		Destination SymlinkDestination `yaml:"destination"`
-		Encrypted   bool               `yaml:"encrypted"`
+		Target      SymlinkTarget        `yaml:"target"`
+		Destination SymlinkDestination   `yaml:"destination"`
+		Encrypted   bool                 `yaml:"encrypted"`
+		Template    bool                 `yaml:"template,omitempty"`
+		Mode        string               `yaml:"mode,omitempty"`
+		Permissions interface{}          `yaml:"permissions,omitempty"`
+		Owner       string               `yaml:"owner,omitempty"`
+		Group       string               `yaml:"group,omitempty"`
+		When        *condition.Condition `yaml:"when,omitempty"`
 	}
 
 	err := unmarshal(&aux)
@@ -70,6 +127,42 @@ func (l *Link) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	switch aux.Mode {
+	case "", Symlink, Copy, Hardlink:
+	default:
+		return fmt.Errorf("Unknown link mode: %s", aux.Mode)
+	}
+
+	// permissions are given in octal, such as 0600, which yaml already decodes
+	// as an octal integer unless it is quoted
+	var permissions uint64
+	switch value := aux.Permissions.(type) {
+	case nil:
+	case int:
+		permissions = uint64(value)
+		if value < 0 {
+			err = fmt.Errorf("negative")
+		}
+	case string:
+		permissions, err = strconv.ParseUint(value, 8, 32)
+	default:
+		err = fmt.Errorf("not a number")
+	}
+
+	if err != nil || os.FileMode(permissions)&^os.ModePerm != 0 {
+		return fmt.Errorf("Invalid permissions: %v, expected an octal mode such as 0600", aux.Permissions)
+	}
+
+	// symlinks are hashed as before modes were introduced
+	if aux.Mode == Symlink {
+		aux.Mode = ""
+	}
+
+	// the condition decides whether the link is created, not what it links, so
+	// it is not hashed
+	when := aux.When
+	aux.When = nil
+
 	b, err := yaml.Marshal(&aux)
 	if err != nil {
 		return err
@@ -79,9 +172,99 @@ func (l *Link) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		Target:      aux.Target,
 		Destination: aux.Destination,
 		Encrypted:   aux.Encrypted,
+		Template:    aux.Template,
+		Mode:        aux.Mode,
+		Permissions: os.FileMode(permissions),
+		Owner:       aux.Owner,
+		Group:       aux.Group,
+		When:        when,
 		Queued:      true,
 		SHA1:        hasher.SHA1FromBytes(b),
 	}
 
 	return nil
 }
+
+// Placed returns true if the target is placed at the destination as a file of
+// its own, rather than as a symlink. The contents of such a target are tracked,
+// as changes to the target are not reflected at the destination.
+func (l *Link) Placed() bool {
+	return l.Template || l.Mode == Copy || l.Mode == Hardlink
+}
+
+// File returns the file whose permissions and ownership are managed by the
+// link. The permissions of a symlink are those of its target.
+func (l *Link) File() string {
+	if l.Placed() {
+		return string(l.Destination)
+	}
+
+	return string(l.Target)
+}
+
+// Prepare attaches the data that the target of a template link is rendered
+// with, and hashes the contents of a placed target with the link, so that the
+// link is placed again when the target or the data changes. An encrypted target
+// is hashed in its encrypted form, as it is only decrypted during provisioning,
+// unless it has not been encrypted yet. Targets are read with read.
+func (l *Link) Prepare(data *TemplateData, read func(file string) ([]byte, error)) error {
+	if !l.Placed() {
+		return nil
+	}
+
+	file := string(l.Target)
+
+	var contents []byte
+	var err error
+
+	if l.Encrypted {
+		contents, err = read(file + ".encrypted")
+	}
+
+	if !l.Encrypted || err != nil {
+		contents, err = read(file)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	SHA1 := l.SHA1 + hasher.SHA1FromBytes(contents)
+
+	if l.Template {
+		l.Data = data
+
+		b, err := yaml.Marshal(data)
+		if err != nil {
+			return err
+		}
+
+		SHA1 += hasher.SHA1FromBytes(b)
+	}
+
+	l.SHA1 = hasher.SHA1FromString(SHA1)
+
+	return nil
+}
+
+// Render renders the target of a template link with text/template
+func (l *Link) Render() ([]byte, error) {
+	b, err := ioutil.ReadFile(string(l.Target))
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := template.New(path.Base(string(l.Target))).Option("missingkey=error").Parse(string(b))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	err = tmpl.Execute(&buf, l.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,125 @@
+package linker
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/autonomy/alterant/link"
+)
+
+// lookupOwner returns the uid of a user given by name or uid
+func lookupOwner(owner string) (int, error) {
+	if uid, err := strconv.Atoi(owner); err == nil {
+		return uid, nil
+	}
+
+	u, err := user.Lookup(owner)
+	if err != nil {
+		return 0, fmt.Errorf("Unknown owner: %s", owner)
+	}
+
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGroup returns the gid of a group given by name or gid
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, fmt.Errorf("Unknown group: %s", group)
+	}
+
+	return strconv.Atoi(g.Gid)
+}
+
+// attributed returns true if the link declares permissions or ownership
+func attributed(l *link.Link) bool {
+	return l.Permissions != 0 || l.Owner != "" || l.Group != ""
+}
+
+// applyAttributes sets the permissions and ownership that a link declares on
+// the file that it manages, correcting any that have changed since the link was
+// created
+func (dl *DefaultLinker) applyAttributes(l *link.Link) error {
+	if !attributed(l) {
+		return nil
+	}
+
+	file := l.File()
+
+	stat, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+
+	if l.Permissions != 0 && stat.Mode().Perm() != l.Permissions {
+		err = os.Chmod(file, l.Permissions)
+		if err != nil {
+			return err
+		}
+
+		dl.logger.Info(2, "Permissions set: %s %04o", file, l.Permissions)
+	}
+
+	uid, gid := -1, -1
+
+	if l.Owner != "" {
+		uid, err = lookupOwner(l.Owner)
+		if err != nil {
+			return err
+		}
+	}
+
+	if l.Group != "" {
+		gid, err = lookupGroup(l.Group)
+		if err != nil {
+			return err
+		}
+	}
+
+	sys := stat.Sys().(*syscall.Stat_t)
+	if (uid == -1 || uint32(uid) == sys.Uid) && (gid == -1 || uint32(gid) == sys.Gid) {
+		return nil
+	}
+
+	err = os.Chown(file, uid, gid)
+	if err != nil {
+		return err
+	}
+
+	dl.logger.Info(2, "Ownership set: %s %s:%s", file, l.Owner, l.Group)
+
+	return nil
+}
+
+// ApplyAttributes verifies the permissions and ownership of the files managed
+// by links that are already in place
+func (dl *DefaultLinker) ApplyAttributes(links []*link.Link) error {
+	if !dl.enabled || dl.dryRun {
+		return nil
+	}
+
+	for _, l := range links {
+		if !attributed(l) {
+			continue
+		}
+
+		if _, err := os.Stat(l.File()); os.IsNotExist(err) {
+			dl.logger.Info(2, "File does not exist: %s", l.File())
+			continue
+		}
+
+		err := dl.applyAttributes(l)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package linker
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The reasons that a managed symlink is cruft
+const (
+	// Broken means that the target of the symlink no longer exists
+	Broken = "broken"
+	// Orphaned means that no link of the machine declares the symlink
+	Orphaned = "orphaned"
+)
+
+// Cruft is a symlink into a machine's repository that is broken or no longer
+// declared by the machine
+type Cruft struct {
+	Path   string
+	Target string
+	Reason string
+}
+
+// managedTarget returns the absolute target of a symlink, and whether it
+// points into root
+func managedTarget(file string, root string) (string, bool) {
+	target, err := os.Readlink(file)
+	if err != nil {
+		return "", false
+	}
+
+	if !path.IsAbs(target) {
+		target = path.Join(path.Dir(file), target)
+	}
+
+	return target, strings.HasPrefix(target, root+"/")
+}
+
+// FindCruft returns the symlinks into root that are broken or not declared
+// by any link. The destinations recorded for the machine are examined, as well
+// as the home directory up to depth levels deep. Declared maps the destination
+// of every declared symlink to its target.
+func FindCruft(root string, recorded []string, declared map[string]string, home string, depth int) ([]Cruft, error) {
+	candidates := make(map[string]bool)
+
+	for _, destination := range recorded {
+		candidates[destination] = true
+	}
+
+	base := strings.Count(path.Clean(home), "/")
+
+	err := filepath.Walk(home, func(file string, info os.FileInfo, err error) error {
+		// unreadable directories are skipped rather than failing the scan
+		if err != nil {
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			candidates[file] = true
+			return nil
+		}
+
+		// the repositories of the machines are not scanned
+		if info.IsDir() && (file == path.Dir(root) || strings.Count(file, "/")-base >= depth) {
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var files []string
+	for file := range candidates {
+		files = append(files, file)
+	}
+
+	sort.Strings(files)
+
+	var cruft []Cruft
+	for _, file := range files {
+		target, ok := managedTarget(file, root)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case declared[file] != target:
+			cruft = append(cruft, Cruft{Path: file, Target: target, Reason: Orphaned})
+		case !exists(target):
+			cruft = append(cruft, Cruft{Path: file, Target: target, Reason: Broken})
+		}
+	}
+
+	return cruft, nil
+}
+
+func exists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
+
+// RemoveCruft removes symlinks found by FindCruft
+func (dl *DefaultLinker) RemoveCruft(cruft []Cruft) error {
+	for _, c := range cruft {
+		err := dl.removeLink(c.Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
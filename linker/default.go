@@ -1,15 +1,19 @@
 package linker
 
-// TODO: add a command to remove cruft and broken links from the home folder
-// that have been managed by alterant
-
 import (
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
+	"strings"
+	"time"
 
+	"github.com/autonomy/alterant/backup"
+	"github.com/autonomy/alterant/hasher"
 	"github.com/autonomy/alterant/link"
 	"github.com/autonomy/alterant/logger"
+	"github.com/autonomy/alterant/task"
 )
 
 //DefaultLinker is a basic symlink manager and is the default
@@ -18,6 +22,10 @@ type DefaultLinker struct {
 	enabled bool
 	parents bool
 	clobber bool
+	dryRun  bool
+
+	// backup receives the files that are clobbered, or nil if they are removed
+	backup *backup.Backup
 }
 
 func isSymlink(link string) (bool, error) {
@@ -59,6 +67,18 @@ func (dl *DefaultLinker) clobberPath(path string) error {
 		return nil
 	}
 
+	// move anything in the way aside, so that it can be restored
+	if dl.backup != nil {
+		moved, err := dl.backup.Save(path)
+		if err != nil {
+			return err
+		}
+
+		dl.logger.Info(2, "Backed up: %s -> %s", path, moved)
+
+		return nil
+	}
+
 	// remove the file/dir if it is not a symlink
 	if stat.Mode()&os.ModeSymlink == 0 {
 		err := os.RemoveAll(path)
@@ -88,10 +108,373 @@ func (dl *DefaultLinker) createParents(link string) error {
 	return nil
 }
 
+// contentOf returns the SHA1 of the contents of a file
+func contentOf(file string) (string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	return hasher.SHA1FromBytes(b), nil
+}
+
+// edited returns true if the file at the destination of a placed link no
+// longer has the contents that were recorded when it was placed
+func edited(l *link.Link) (bool, error) {
+	content, err := contentOf(string(l.Destination))
+	if err != nil {
+		return false, err
+	}
+
+	return content != l.Content, nil
+}
+
+// removePlaced removes a file that was copied, hard linked or rendered to its
+// destination. A file that has been edited since it was placed, or for which
+// there is no record of what was placed, is only removed when clobbering, and
+// is backed up if backups are enabled, so that local edits are not lost.
+func (dl *DefaultLinker) removePlaced(l *link.Link) error {
+	file := string(l.Destination)
+
+	stat, err := os.Lstat(file)
+	if os.IsNotExist(err) {
+		dl.logger.Info(2, "File does not exist: %s", file)
+		return nil
+	}
+
+	// only remove regular files, as anything else was not placed by alterant
+	if !stat.Mode().IsRegular() {
+		dl.logger.Info(2, "File not managed by alterant: %s", file)
+		return nil
+	}
+
+	// the contents of a file without a record of what was placed are unknown
+	modified := l.Content == ""
+	if !modified {
+		modified, err = edited(l)
+		if err != nil {
+			return err
+		}
+	}
+
+	if modified {
+		if !dl.clobber {
+			if l.Content == "" {
+				dl.logger.Warning(2, "No record of the file placed at %s, leaving it in place, use --clobber to remove it", file)
+			} else {
+				dl.logger.Warning(2, "File has local edits since it was placed, leaving it in place, use --clobber to remove it: %s", file)
+			}
+
+			return nil
+		}
+
+		if dl.backup != nil {
+			moved, err := dl.backup.Save(file)
+			if err != nil {
+				return err
+			}
+
+			dl.logger.Info(2, "Backed up: %s -> %s", file, moved)
+
+			return nil
+		}
+
+		dl.logger.Warning(2, "Discarding local edits: %s", file)
+	}
+
+	if err := os.Remove(file); err != nil {
+		return err
+	}
+
+	dl.logger.Info(2, "File removed: %s", file)
+
+	return nil
+}
+
+// place copies, hard links or renders the target of a link to its destination
+// and records the SHA1 of the placed contents
+func (dl *DefaultLinker) place(l *link.Link) error {
+	target := string(l.Target)
+	destination := string(l.Destination)
+
+	stat, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+
+	if !stat.Mode().IsRegular() {
+		return fmt.Errorf("Only files can be %s: %s", placedAs(l), target)
+	}
+
+	var b []byte
+
+	switch {
+	case l.Template:
+		b, err = l.Render()
+		if err != nil {
+			return fmt.Errorf("Failed to render %s: %s", target, err)
+		}
+
+		err = ioutil.WriteFile(destination, b, 0644)
+	case l.Mode == link.Copy:
+		b, err = ioutil.ReadFile(target)
+		if err != nil {
+			return err
+		}
+
+		err = ioutil.WriteFile(destination, b, stat.Mode().Perm())
+	case l.Mode == link.Hardlink:
+		b, err = ioutil.ReadFile(target)
+		if err != nil {
+			return err
+		}
+
+		err = os.Link(target, destination)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	l.Content = hasher.SHA1FromBytes(b)
+
+	return nil
+}
+
+// placedAs describes how the target of a link was placed at its destination
+func placedAs(l *link.Link) string {
+	switch {
+	case l.Template:
+		return "rendered"
+	case l.Mode == link.Hardlink:
+		return "hard linked"
+	default:
+		return "copied"
+	}
+}
+
+// The states of a link's destination
+const (
+	// missing means that nothing is at the destination
+	missing = iota
+	// linked means that the destination already links to the target
+	linked
+	// mismatched means that the destination is a symlink to another target
+	mismatched
+	// occupied means that something other than a symlink is at the destination
+	occupied
+)
+
+// destinationState returns the state of a link's destination, and the target
+// of a symlink found there
+func destinationState(l *link.Link) (int, string) {
+	destination := string(l.Destination)
+
+	stat, err := os.Lstat(destination)
+	if os.IsNotExist(err) {
+		return missing, ""
+	}
+
+	if stat.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(destination)
+		if err == nil && target == string(l.Target) && !l.Placed() {
+			return linked, target
+		}
+
+		return mismatched, target
+	}
+
+	// a template is in place if the destination has what the target renders
+	// to, a hard link if the destination is the target, and a copy if the
+	// destination has the contents of the target
+	switch {
+	case l.Template:
+		b, err := l.Render()
+		if err == nil && stat.Mode().IsRegular() {
+			if content, err := contentOf(destination); err == nil && content == hasher.SHA1FromBytes(b) {
+				return linked, ""
+			}
+		}
+	case l.Mode == link.Hardlink:
+		if targetStat, err := os.Stat(string(l.Target)); err == nil && os.SameFile(stat, targetStat) {
+			return linked, ""
+		}
+	case l.Mode == link.Copy:
+		target, err := contentOf(string(l.Target))
+		if err == nil && stat.Mode().IsRegular() {
+			if content, err := contentOf(destination); err == nil && content == target {
+				return linked, ""
+			}
+		}
+	}
+
+	return occupied, ""
+}
+
+// planLink describes what creating a link would do to the destination
+func (dl *DefaultLinker) planLink(l *link.Link) string {
+	destination := string(l.Destination)
+
+	state, _ := destinationState(l)
+	switch {
+	case state == missing:
+		if _, err := os.Stat(path.Dir(destination)); os.IsNotExist(err) && !dl.parents {
+			return "missing parent"
+		}
+
+		return "create"
+	case state == linked:
+		return "linked"
+	case dl.clobber:
+		return "clobber"
+	case state == mismatched:
+		return "mismatch"
+	}
+
+	return "conflict"
+}
+
+// within returns true if file is dir or is inside it
+func within(file string, dir string) bool {
+	file = path.Clean(file)
+	dir = path.Clean(dir)
+
+	return file == dir || dir == "/" || strings.HasPrefix(file, dir+"/")
+}
+
+// linkProblems returns what prevents a link from being created. The target
+// must exist, or be decrypted from its encrypted counterpart, and the parent of
+// the destination must exist unless parents are made as needed. A link may not
+// place the whole repository, nor replace $HOME or $ALTERANT_HOME, as
+// clobbering the destination would remove them.
+func (dl *DefaultLinker) linkProblems(l *link.Link) []string {
+	var problems []string
+
+	target := string(l.Target)
+	destination := string(l.Destination)
+
+	if target == "" {
+		problems = append(problems, fmt.Sprintf("Empty target for destination: %s", destination))
+	} else if cwd, err := os.Getwd(); err == nil && path.Clean(target) == cwd {
+		problems = append(problems, fmt.Sprintf("Target is the root of the repository: %s", target))
+	} else if _, err := os.Lstat(target); os.IsNotExist(err) {
+		if !l.Encrypted {
+			problems = append(problems, fmt.Sprintf("Target does not exist: %s", target))
+		} else if _, err := os.Stat(target + ".encrypted"); os.IsNotExist(err) {
+			problems = append(problems, fmt.Sprintf("Encrypted target does not exist: %s.encrypted", target))
+		}
+	}
+
+	if destination == "" {
+		return append(problems, fmt.Sprintf("Empty destination for target: %s", target))
+	}
+
+	for _, variable := range []string{"HOME", "ALTERANT_HOME"} {
+		if dir := os.Getenv(variable); dir != "" && within(dir, destination) {
+			problems = append(problems, fmt.Sprintf("Destination is $%s or one of its parents: %s", variable, destination))
+			break
+		}
+	}
+
+	if !dl.parents {
+		if _, err := os.Stat(path.Dir(destination)); os.IsNotExist(err) {
+			problems = append(problems, fmt.Sprintf("Parent of destination does not exist: %s, use --parents to create it", destination))
+		}
+	}
+
+	return problems
+}
+
+func problemsError(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("Invalid links:\n  %s", strings.Join(problems, "\n  "))
+}
+
+// ValidateLinks verifies that the queued links of the tasks can be created, so
+// that a problem with any of them is found before a change is made. No two
+// links of any of the tasks may share a destination, whether they are queued or
+// not.
+func (dl *DefaultLinker) ValidateLinks(tasks []*task.Task) error {
+	if !dl.enabled {
+		return nil
+	}
+
+	var problems []string
+	destinations := make(map[string]string)
+
+	for _, t := range tasks {
+		for _, l := range t.Links {
+			destination := string(l.Destination)
+
+			// identical links within a task have already been removed, so any
+			// link that shares a destination is a conflict
+			if other, ok := destinations[destination]; ok {
+				problems = append(problems, fmt.Sprintf("Duplicate destination: %s is linked by %s and %s", destination, other, t.Name))
+			} else {
+				destinations[destination] = t.Name
+			}
+
+			if t.Queued && l.Queued {
+				problems = append(problems, dl.linkProblems(l)...)
+			}
+		}
+	}
+
+	return problemsError(problems)
+}
+
 // RemoveLinks removes symlinks
-func (dl *DefaultLinker) RemoveLinks(links map[string]*link.Link) error {
+func (dl *DefaultLinker) RemoveLinks(links []*link.Link) error {
+
+	// do not remove links if not enabled
+	if !dl.enabled {
+		return nil
+	}
+
 	for _, link := range links {
-		err := dl.removeLink(string(link.Destination))
+		destination := string(link.Destination)
+
+		if dl.dryRun {
+			fmt.Printf("    link remove: %s -> %s\n", link.Destination, link.Target)
+			continue
+		}
+
+		if link.Placed() {
+			err := dl.removePlaced(link)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		target, err := os.Readlink(destination)
+		if os.IsNotExist(err) {
+			dl.logger.Info(2, "Symlink does not exist: %s", destination)
+			continue
+		}
+
+		if err != nil {
+			// anything other than a symlink has replaced the link since it was
+			// created, so it is not alterant's to remove
+			if ok, statErr := isSymlink(destination); statErr == nil && !ok {
+				dl.logger.Info(2, "File is not a symlink, leaving it in place: %s", destination)
+				continue
+			}
+
+			return err
+		}
+
+		// only remove links that point to the target managed by alterant
+		if target != string(link.Target) {
+			dl.logger.Info(2, "Symlink not managed by alterant: %s -> %s", destination, target)
+			continue
+		}
+
+		err = dl.removeLink(destination)
 		if err != nil {
 			return err
 		}
@@ -101,18 +484,80 @@ func (dl *DefaultLinker) RemoveLinks(links map[string]*link.Link) error {
 }
 
 // CreateLinks creates symlinks
-func (dl *DefaultLinker) CreateLinks(links map[string]*link.Link) error {
+func (dl *DefaultLinker) CreateLinks(links []*link.Link) error {
 
 	// do not create links if not enabled
 	if !dl.enabled {
 		return nil
 	}
 
+	if !dl.dryRun {
+		var problems []string
+		for _, l := range links {
+			if l.Queued {
+				problems = append(problems, dl.linkProblems(l)...)
+			}
+		}
+
+		err := problemsError(problems)
+		if err != nil {
+			return err
+		}
+	}
+
 	for _, link := range links {
+		if dl.dryRun {
+			action := "unchanged"
+			if link.Queued {
+				action = dl.planLink(link)
+			}
+
+			fmt.Printf("    link %s: %s -> %s\n", action, link.Destination, link.Target)
+
+			continue
+		}
+
 		if !link.Queued {
 			continue
 		}
 
+		state, current := destinationState(link)
+		switch {
+		case state == linked:
+			// the link is already in place, which is not an error
+			if link.Placed() {
+				content, err := contentOf(string(link.Destination))
+				if err != nil {
+					return err
+				}
+
+				link.Content = content
+			}
+
+			err := dl.applyAttributes(link)
+			if err != nil {
+				return err
+			}
+
+			link.Applied = time.Now()
+
+			dl.logger.Info(2, "Already linked: %s -> %s", link.Destination, link.Target)
+
+			continue
+		case state == mismatched && !dl.clobber:
+			return fmt.Errorf("Symlink points elsewhere: %s -> %s, expected %s, use --clobber to replace it", link.Destination, current, link.Target)
+		case state == occupied && !dl.clobber:
+			// a destination with local edits is most likely a file that was
+			// placed by alterant and then edited in place
+			if link.Placed() && link.Content != "" {
+				if modified, err := edited(link); err == nil && modified {
+					return fmt.Errorf("Destination has local edits since it was placed: %s, use --clobber to replace it", link.Destination)
+				}
+			}
+
+			return fmt.Errorf("Destination already exists: %s, use --clobber to replace it", link.Destination)
+		}
+
 		if dl.parents {
 			err := dl.createParents(string(link.Destination))
 			if err != nil {
@@ -120,31 +565,70 @@ func (dl *DefaultLinker) CreateLinks(links map[string]*link.Link) error {
 			}
 		}
 
-		if dl.clobber {
+		if state != missing {
 			err := dl.clobberPath(string(link.Destination))
 			if err != nil {
 				return err
 			}
 		}
 
-		// TODO: validate symlinks
+		if link.Placed() {
+			err := dl.place(link)
+			if err != nil {
+				return err
+			}
+
+			err = dl.applyAttributes(link)
+			if err != nil {
+				return err
+			}
+
+			link.Applied = time.Now()
+
+			dl.logger.Info(2, "File %s: %s -> %s", placedAs(link), link.Destination, link.Target)
+
+			continue
+		}
+
 		err := os.Symlink(string(link.Target), string(link.Destination))
 		if err != nil {
 			return err
 		}
 
+		err = dl.applyAttributes(link)
+		if err != nil {
+			return err
+		}
+
+		link.Applied = time.Now()
+
 		dl.logger.Info(2, "Symlink created: %s -> %s", link.Destination, link.Target)
 	}
 
 	return nil
 }
 
+// WithLogger returns a copy of the linker that logs to logger
+func (dl *DefaultLinker) WithLogger(logger *logWrapper.LogWrapper) Linker {
+	l := *dl
+	l.logger = logger
+
+	return &l
+}
+
 // NewDefaultLinker returns an instance of `DefaultLinker`
-func NewDefaultLinker(enabled bool, parents bool, clobber bool, logger *logWrapper.LogWrapper) *DefaultLinker {
-	return &DefaultLinker{
+func NewDefaultLinker(enabled bool, parents bool, clobber bool, backupFiles bool, dryRun bool, logger *logWrapper.LogWrapper) *DefaultLinker {
+	dl := &DefaultLinker{
 		logger:  logger,
 		enabled: enabled,
 		parents: parents,
 		clobber: clobber,
+		dryRun:  dryRun,
 	}
+
+	if backupFiles {
+		dl.backup = backup.New()
+	}
+
+	return dl
 }
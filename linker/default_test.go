@@ -0,0 +1,131 @@
+package linker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/autonomy/alterant/link"
+	"github.com/autonomy/alterant/logger"
+)
+
+func TestCreateLinksUnchangedTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alterant")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+
+	os.Setenv("HOME", path.Join(dir, "home"))
+
+	err = os.Mkdir(path.Join(dir, "home"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := path.Join(dir, "gitconfig.tmpl")
+
+	err = ioutil.WriteFile(target, []byte("[user]\n\tname = {{.Machine}}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &link.Link{
+		Target:      link.SymlinkTarget(target),
+		Destination: link.SymlinkDestination(path.Join(dir, "home", ".gitconfig")),
+		Template:    true,
+		Data:        &link.TemplateData{Machine: "laptop"},
+		Queued:      true,
+	}
+
+	dl := NewDefaultLinker(true, false, false, false, false, logWrapper.NewLogWrapper(false))
+
+	// a forced task creates its unchanged links again
+	for i := 0; i < 2; i++ {
+		err = dl.CreateLinks([]*link.Link{l})
+		if err != nil {
+			t.Fatalf("run %d: %s", i, err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(string(l.Destination))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "[user]\n\tname = laptop\n"; string(b) != expected {
+		t.Fatalf("expected %q, got %q", expected, string(b))
+	}
+
+	// a destination that no longer has the rendered contents is not replaced
+	err = ioutil.WriteFile(string(l.Destination), []byte("edited\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = dl.CreateLinks([]*link.Link{l}); err == nil {
+		t.Fatal("expected an error for an edited destination")
+	}
+}
+
+func TestCreateLinksEditedCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alterant")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+
+	os.Setenv("HOME", path.Join(dir, "home"))
+
+	err = os.Mkdir(path.Join(dir, "home"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := path.Join(dir, "vimrc")
+
+	err = ioutil.WriteFile(target, []byte("set number\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &link.Link{
+		Target:      link.SymlinkTarget(target),
+		Destination: link.SymlinkDestination(path.Join(dir, "home", ".vimrc")),
+		Mode:        link.Copy,
+		Queued:      true,
+	}
+
+	dl := NewDefaultLinker(true, false, false, false, false, logWrapper.NewLogWrapper(false))
+
+	err = dl.CreateLinks([]*link.Link{l})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the target changes after the copy is edited in place
+	for file, contents := range map[string]string{
+		string(l.Destination): "set number\nset hlsearch\n",
+		target:                "set relativenumber\n",
+	} {
+		err = ioutil.WriteFile(file, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = dl.CreateLinks([]*link.Link{l})
+	if err == nil || !strings.Contains(err.Error(), "local edits") {
+		t.Fatalf("expected an error about local edits, got %v", err)
+	}
+}
@@ -1,9 +1,16 @@
 package linker
 
-import "github.com/autonomy/alterant/link"
+import (
+	"github.com/autonomy/alterant/link"
+	"github.com/autonomy/alterant/logger"
+	"github.com/autonomy/alterant/task"
+)
 
 // Linker is the interface to a symlink handler
 type Linker interface {
-	RemoveLinks(map[string]*link.Link) error
-	CreateLinks(map[string]*link.Link) error
+	ValidateLinks([]*task.Task) error
+	RemoveLinks([]*link.Link) error
+	CreateLinks([]*link.Link) error
+	ApplyAttributes([]*link.Link) error
+	WithLogger(*logWrapper.LogWrapper) Linker
 }
@@ -1,24 +1,70 @@
 package logWrapper
 
 import (
+	"bytes"
+	"io"
 	"log"
+	"os"
 	"strings"
 )
 
 // LogWrapper formats log output specific to alterant
 type LogWrapper struct {
 	Verbose bool
+	logger  *log.Logger
+	stdout  io.Writer
+	stderr  io.Writer
+	stdin   io.Reader
 }
 
 // Info displays messages in green
 func (l *LogWrapper) Info(level int, format string, v ...interface{}) {
 	format = "\033[36m\033[1m" + "<" + strings.Repeat("=", level) + "> " + format + "\033[0m"
 	if l.Verbose {
-		log.Printf(format, v...)
+		l.logger.Printf(format, v...)
 	}
 }
 
+// Warning displays messages in yellow, whether or not the output is verbose
+func (l *LogWrapper) Warning(level int, format string, v ...interface{}) {
+	format = "\033[33m\033[1m" + "<" + strings.Repeat("=", level) + "> " + format + "\033[0m"
+	l.logger.Printf(format, v...)
+}
+
+// Stdout returns the writer for the standard output of commands
+func (l *LogWrapper) Stdout() io.Writer {
+	return l.stdout
+}
+
+// Stderr returns the writer for the standard error of commands
+func (l *LogWrapper) Stderr() io.Writer {
+	return l.stderr
+}
+
+// Stdin returns the reader for the standard input of commands, which is nil
+// if the output is buffered
+func (l *LogWrapper) Stdin() io.Reader {
+	return l.stdin
+}
+
 // NewLogWrapper returns an instance of `LogWrapper`
 func NewLogWrapper(verbose bool) *LogWrapper {
-	return &LogWrapper{Verbose: verbose}
+	return &LogWrapper{
+		Verbose: verbose,
+		logger:  log.New(os.Stderr, "", log.LstdFlags),
+		stdout:  os.Stdout,
+		stderr:  os.Stderr,
+		stdin:   os.Stdin,
+	}
+}
+
+// NewBufferedLogWrapper returns an instance of `LogWrapper` that writes all
+// messages and command output to buf
+func NewBufferedLogWrapper(verbose bool, buf *bytes.Buffer) *LogWrapper {
+	return &LogWrapper{
+		Verbose: verbose,
+		logger:  log.New(buf, "", log.LstdFlags),
+		stdout:  buf,
+		stderr:  buf,
+	}
 }
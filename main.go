@@ -6,17 +6,23 @@ package main
 // TODO: add encryption groups that can be encrypted with different passwords/keys
 // TODO: add `update` command that cleans the current environment, pulls the
 // updated repo and reprovisions the machine
-// TODO: add an `update_strategy` section to the config that can indicate options
-// for updating
 
 import (
+	"bufio"
+	"fmt"
 	"log"
 	"os"
 	"path"
+	"strings"
 
+	"github.com/autonomy/alterant/backup"
+	"github.com/autonomy/alterant/cache"
 	"github.com/autonomy/alterant/config"
 	"github.com/autonomy/alterant/encrypter"
+	"github.com/autonomy/alterant/graph"
+	"github.com/autonomy/alterant/linker"
 	"github.com/autonomy/alterant/logger"
+	"github.com/autonomy/alterant/plan"
 	"github.com/autonomy/alterant/provisioner"
 	"github.com/autonomy/alterant/repo"
 	"github.com/codegangsta/cli"
@@ -24,6 +30,20 @@ import (
 
 var version string
 
+// confirm asks a yes or no question on the terminal, defaulting to no
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
+}
+
 func main() {
 	alterantHome := os.Getenv("HOME") + "/.alterant"
 	os.Setenv("ALTERANT_HOME", alterantHome)
@@ -85,7 +105,40 @@ func main() {
 				},
 				cli.BoolFlag{
 					Name:  "clobber",
-					Usage: "remove existing files/directories before linking, defaults to false",
+					Usage: "replace existing files/directories when linking, defaults to false",
+				},
+				cli.BoolTFlag{
+					Name:  "backup",
+					Usage: "move clobbered files/directories to $ALTERANT_HOME/backups instead of removing them, defaults to true",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print the changes that would be made without making them, defaults to false",
+				},
+				cli.IntFlag{
+					Name:  "jobs",
+					Value: 1,
+					Usage: "number of independent tasks to provision concurrently",
+				},
+				cli.BoolFlag{
+					Name:  "keep-going",
+					Usage: "continue provisioning tasks that do not depend on a failed task, defaults to false",
+				},
+				cli.StringSliceFlag{
+					Name:  "task",
+					Usage: "provision only the named task and the tasks it depends on, may be repeated",
+				},
+				cli.StringSliceFlag{
+					Name:  "skip",
+					Usage: "do not provision the named task, may be repeated",
+				},
+				cli.StringSliceFlag{
+					Name:  "tags",
+					Usage: "provision only the tasks with any of the comma separated tags and the tasks they depend on",
+				},
+				cli.StringSliceFlag{
+					Name:  "skip-tags",
+					Usage: "do not provision the tasks with any of the comma separated tags",
 				},
 			},
 			Action: func(c *cli.Context) {
@@ -96,9 +149,18 @@ func main() {
 
 				url := c.Args()[0]
 				for _, requestedMachine := range c.Args().Tail() {
-					err := repo.CloneToAlterantDir(url, requestedMachine)
-					if err != nil {
-						log.Fatal(err)
+					// a dry run plans against an existing clone of the machine, as
+					// cloning would change the alterant home
+					_, err := os.Stat(path.Join(alterantHome, requestedMachine))
+					if c.Bool("dry-run") && os.IsNotExist(err) {
+						log.Fatalf("A dry run requires an existing clone of %s, run provision without --dry-run first", requestedMachine)
+					}
+
+					if !c.Bool("dry-run") {
+						err = repo.CloneToAlterantDir(url, requestedMachine)
+						if err != nil {
+							log.Fatal(err)
+						}
 					}
 
 					err = os.Chdir(path.Join(alterantHome, requestedMachine))
@@ -140,7 +202,44 @@ func main() {
 				},
 				cli.BoolFlag{
 					Name:  "clobber",
-					Usage: "remove existing files/directories before linking, defaults to false",
+					Usage: "replace existing files/directories when linking, defaults to false",
+				},
+				cli.BoolTFlag{
+					Name:  "backup",
+					Usage: "move clobbered files/directories to $ALTERANT_HOME/backups instead of removing them, defaults to true",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print the changes that would be made without making them, defaults to false",
+				},
+				cli.IntFlag{
+					Name:  "jobs",
+					Value: 1,
+					Usage: "number of independent tasks to provision concurrently",
+				},
+				cli.BoolFlag{
+					Name:  "keep-going",
+					Usage: "continue provisioning tasks that do not depend on a failed task, defaults to false",
+				},
+				cli.StringSliceFlag{
+					Name:  "task",
+					Usage: "provision only the named task and the tasks it depends on, may be repeated",
+				},
+				cli.StringSliceFlag{
+					Name:  "skip",
+					Usage: "do not provision the named task, may be repeated",
+				},
+				cli.StringSliceFlag{
+					Name:  "tags",
+					Usage: "provision only the tasks with any of the comma separated tags and the tasks they depend on",
+				},
+				cli.StringSliceFlag{
+					Name:  "skip-tags",
+					Usage: "do not provision the tasks with any of the comma separated tags",
+				},
+				cli.BoolFlag{
+					Name:  "propagate",
+					Usage: "queue all transitive dependents of changed tasks, defaults to false",
 				},
 			},
 			Action: func(c *cli.Context) {
@@ -155,9 +254,13 @@ func main() {
 						log.Fatal(err)
 					}
 
-					err = repo.Pull(requestedMachine)
-					if err != nil {
-						log.Fatal(err)
+					// a dry run plans against the current checkout, as pulling would
+					// change the targets of the provisioned links
+					if !c.Bool("dry-run") {
+						err = repo.Pull(requestedMachine)
+						if err != nil {
+							log.Fatal(err)
+						}
 					}
 
 					cfg, err := config.AcquireConfig(requestedMachine)
@@ -175,41 +278,354 @@ func main() {
 
 			},
 		},
-		// {
-		// 	Name:     "remove",
-		// 	Usage:    "remove provisioned tasks",
-		// 	Category: "Provisioning actions",
-		// 	Action: func(c *cli.Context) {
-		// 		if len(c.Args()) == 0 {
-		// 			cli.ShowCommandHelp(c, "remove")
-		// 			os.Exit(1)
-		// 		}
-
-		// 		machine, err := repo.CurrentMachine()
-		// 		if err != nil {
-		// 			log.Fatal(err)
-		// 		}
-
-		// 		cfg, err := config.AcquireConfig(machine)
-		// 		if err != nil {
-		// 			log.Fatal(err)
-		// 		}
-
-		// 		var requests []string
-		// 		if len(c.Args()) == 0 {
-		// 			requests = cfg.Order
-		// 		} else {
-		// 			requests = c.Args()
-		// 		}
-
-		// 		provisioner := provisioner.NewDefaultProvisioner(cfg, c)
-
-		// 		err = provisioner.Remove(requests)
-		// 		if err != nil {
-		// 			log.Fatal(err)
-		// 		}
-		// 	},
-		// },
+		{
+			Name:      "remove",
+			Usage:     "remove provisioned tasks, defaults to all tasks",
+			Category:  "Provisioning actions",
+			ArgsUsage: "[tasks...]",
+			Flags: []cli.Flag{
+				cli.BoolTFlag{
+					Name:  "links",
+					Usage: "remove links, defaults to true",
+				},
+				cli.BoolTFlag{
+					Name:  "commands",
+					Usage: "execute teardown commands, defaults to true",
+				},
+			},
+			Action: func(c *cli.Context) {
+				machine, err := repo.CurrentMachine()
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				cfg, err := config.AcquireConfig(machine)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				var requests []string
+				if len(c.Args()) == 0 {
+					for _, task := range cfg.Tasks {
+						requests = append(requests, task.Name)
+					}
+				} else {
+					requests = c.Args()
+				}
+
+				provisioner := provisioner.NewDefaultProvisioner(cfg, c)
+
+				err = provisioner.Remove(requests)
+				if err != nil {
+					log.Fatal(err)
+				}
+			},
+		},
+		{
+			Name:      "clean",
+			Usage:     "remove broken and orphaned symlinks into a machine",
+			Category:  "Provisioning actions",
+			ArgsUsage: "machine",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "yes",
+					Usage: "remove the symlinks without asking for confirmation, defaults to false",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "list the symlinks without removing them, defaults to false",
+				},
+				cli.IntFlag{
+					Name:  "depth",
+					Value: 3,
+					Usage: "number of directory levels of the home directory to scan",
+				},
+			},
+			Action: func(c *cli.Context) {
+				if len(c.Args()) != 1 {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+
+				machine := c.Args().First()
+				root := path.Join(alterantHome, machine)
+
+				err := os.Chdir(root)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				cfg, err := config.AcquireConfig(machine)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				declared := make(map[string]string)
+				for _, t := range cfg.Tasks {
+					for _, l := range t.Links {
+						if !l.Placed() {
+							declared[string(l.Destination)] = string(l.Target)
+						}
+					}
+				}
+
+				cachedMachine, err := cache.ReadMachine(machine)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				var recorded []string
+				if cachedMachine != nil {
+					for _, t := range cachedMachine.Tasks {
+						for _, l := range t.Links {
+							if l.Destination != "" {
+								recorded = append(recorded, l.Destination)
+							}
+						}
+					}
+				}
+
+				cruft, err := linker.FindCruft(root, recorded, declared, os.Getenv("HOME"), c.Int("depth"))
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				if len(cruft) == 0 {
+					fmt.Println("No broken or orphaned symlinks found")
+					return
+				}
+
+				for _, symlink := range cruft {
+					fmt.Printf("%s\t%s -> %s\n", symlink.Reason, symlink.Path, symlink.Target)
+				}
+
+				if c.Bool("dry-run") {
+					return
+				}
+
+				if !c.Bool("yes") && !confirm(fmt.Sprintf("Remove %d symlinks?", len(cruft))) {
+					return
+				}
+
+				logger := logWrapper.NewLogWrapper(c.GlobalBool("verbose"))
+
+				err = linker.NewDefaultLinker(true, false, false, false, false, logger).RemoveCruft(cruft)
+				if err != nil {
+					log.Fatal(err)
+				}
+			},
+		},
+		{
+			Name:      "restore",
+			Usage:     "restore files that were backed up when clobbering, or list the backups",
+			Category:  "Provisioning actions",
+			ArgsUsage: "[backup]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "replace files that have taken the place of backed up files, defaults to false",
+				},
+			},
+			Action: func(c *cli.Context) {
+				if len(c.Args()) > 1 {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+
+				if len(c.Args()) == 0 {
+					names, err := backup.List()
+					if err != nil {
+						log.Fatal(err)
+					}
+
+					for _, name := range names {
+						m, err := backup.ReadManifest(name)
+						if err != nil {
+							log.Fatal(err)
+						}
+
+						fmt.Printf("%s\t%d files\n", name, len(m.Entries))
+					}
+
+					return
+				}
+
+				logger := logWrapper.NewLogWrapper(c.GlobalBool("verbose"))
+
+				err := backup.Restore(c.Args().First(), c.Bool("force"), func(entry backup.Entry) {
+					logger.Info(2, "Restored: %s", entry.Path)
+				})
+				if err != nil {
+					log.Fatal(err)
+				}
+			},
+		},
+		{
+			Name:      "plan",
+			Usage:     "show the changes an update would make to a machine",
+			Category:  "Provisioning actions",
+			ArgsUsage: "machine",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: "text",
+					Usage: "output format, either text or json",
+				},
+				cli.BoolFlag{
+					Name:  "propagate",
+					Usage: "queue all transitive dependents of changed tasks, defaults to false",
+				},
+			},
+			Action: func(c *cli.Context) {
+				if len(c.Args()) != 1 {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+
+				machine := c.Args().First()
+
+				err := os.Chdir(path.Join(alterantHome, machine))
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				cfg, err := config.AcquireConfig(machine)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				if c.Bool("propagate") {
+					cfg.UpdateStrategy.Propagate = true
+				}
+
+				cachedMachine, err := cache.ReadMachine(machine)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				p := plan.NewPlan(cfg, cachedMachine)
+
+				switch c.String("format") {
+				case "text":
+					err = p.WriteText(os.Stdout)
+				case "json":
+					err = p.WriteJSON(os.Stdout)
+				default:
+					err = fmt.Errorf("Unknown format: %s", c.String("format"))
+				}
+
+				if err != nil {
+					log.Fatal(err)
+				}
+			},
+		},
+		{
+			Name:      "graph",
+			Usage:     "show the task dependency graph of a machine",
+			Category:  "Provisioning actions",
+			ArgsUsage: "machine",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: "dot",
+					Usage: "output format, either dot or json",
+				},
+				cli.BoolFlag{
+					Name:  "highlight",
+					Usage: "highlight the tasks that an update would provision, defaults to false",
+				},
+				cli.BoolFlag{
+					Name:  "propagate",
+					Usage: "queue all transitive dependents of changed tasks, defaults to false",
+				},
+			},
+			Action: func(c *cli.Context) {
+				if len(c.Args()) != 1 {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+
+				machine := c.Args().First()
+
+				err := os.Chdir(path.Join(alterantHome, machine))
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				cfg, err := config.AcquireConfig(machine)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				if c.Bool("propagate") {
+					cfg.UpdateStrategy.Propagate = true
+				}
+
+				var p *plan.Plan
+				if c.Bool("highlight") {
+					cachedMachine, err := cache.ReadMachine(machine)
+					if err != nil {
+						log.Fatal(err)
+					}
+
+					p = plan.NewPlan(cfg, cachedMachine)
+				}
+
+				g := graph.NewGraph(cfg, p)
+
+				switch c.String("format") {
+				case "dot":
+					err = g.WriteDOT(os.Stdout)
+				case "json":
+					err = g.WriteJSON(os.Stdout)
+				default:
+					err = fmt.Errorf("Unknown format: %s", c.String("format"))
+				}
+
+				if err != nil {
+					log.Fatal(err)
+				}
+			},
+		},
+		{
+			Name:      "validate",
+			Usage:     "report every problem with a machine's config, defaults to the current machine",
+			Category:  "Machine actions",
+			ArgsUsage: "[machine]",
+			Action: func(c *cli.Context) {
+				if len(c.Args()) > 1 {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+
+				var machine string
+				if len(c.Args()) == 1 {
+					machine = c.Args().First()
+
+					err := os.Chdir(path.Join(alterantHome, machine))
+					if err != nil {
+						log.Fatal(err)
+					}
+				} else {
+					var err error
+					machine, err = repo.CurrentMachine()
+					if err != nil {
+						log.Fatal(err)
+					}
+				}
+
+				errs := config.Validate(machine)
+				for _, err := range errs {
+					fmt.Fprintln(os.Stderr, err)
+				}
+
+				if len(errs) != 0 {
+					os.Exit(1)
+				}
+
+				fmt.Printf("%s.yaml is valid\n", machine)
+			},
+		},
 		{
 			Name:      "new",
 			Usage:     "create a new machine",
@@ -0,0 +1,72 @@
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// WriteJSON writes the plan to w as an indented JSON document
+func (p *Plan) WriteJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s\n", b)
+
+	return err
+}
+
+// WriteText writes the plan to w in a human readable form
+func (p *Plan) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "Machine: %s\n", p.Machine)
+
+	for _, pt := range p.Tasks {
+		fmt.Fprintf(w, "  task %s\n", pt.Summary())
+
+		for _, l := range pt.Links {
+			switch {
+			case l.Destination == "":
+				// links cached before destinations were recorded
+				fmt.Fprintf(w, "    link %s: %s\n", l.State, l.SHA1)
+			case l.State == Changed:
+				fmt.Fprintf(w, "    link %s: %s -> %s (was %s)\n", l.State, l.Destination, l.Target, l.CachedTarget)
+			default:
+				fmt.Fprintf(w, "    link %s: %s -> %s\n", l.State, l.Destination, l.Target)
+			}
+		}
+
+		for _, c := range pt.Commands {
+			if c.State == Removed {
+				fmt.Fprintf(w, "    command %s: %s\n", c.State, c.SHA1)
+			} else {
+				fmt.Fprintf(w, "    command %s:\n%s\n", c.State, c.Contents)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Summary describes the planned state of the task in a single line
+func (t *Task) Summary() string {
+	summary := fmt.Sprintf("%s: %s", t.Name, t.State)
+
+	if t.State == Renamed {
+		summary += " from " + t.RenamedFrom
+	}
+
+	switch {
+	case t.Skipped:
+		summary += ", skipped"
+	case t.Requested:
+		summary += ", requested"
+	case t.Forced:
+		summary += ", forced"
+	case t.QueuedBy != "":
+		summary += ", queued by " + t.QueuedBy
+	}
+
+	return summary
+}
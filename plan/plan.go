@@ -0,0 +1,439 @@
+package plan
+
+import (
+	"sort"
+
+	"github.com/autonomy/alterant/cache"
+	"github.com/autonomy/alterant/config"
+	"github.com/autonomy/alterant/link"
+	"github.com/autonomy/alterant/task"
+)
+
+// State describes how an item compares to its cached counterpart
+type State string
+
+const (
+	// New items have not been provisioned before
+	New State = "new"
+	// Unchanged items are identical to what was provisioned
+	Unchanged State = "unchanged"
+	// Changed items differ from what was provisioned
+	Changed State = "changed"
+	// Renamed tasks are identical to a provisioned task of another name
+	Renamed State = "renamed"
+	// Removed items were provisioned but are no longer in the config
+	Removed State = "removed"
+)
+
+// Link represents the planned state of a link
+type Link struct {
+	Target       string `json:"target,omitempty"`
+	Destination  string `json:"destination,omitempty"`
+	CachedTarget string `json:"cached_target,omitempty"`
+	Template     bool   `json:"template,omitempty"`
+	Mode         string `json:"mode,omitempty"`
+	SHA1         string `json:"sha1"`
+	State        State  `json:"state"`
+
+	// cached is the record of the link that was provisioned at the destination
+	cached *cache.Link
+}
+
+// Command represents the planned state of a command
+type Command struct {
+	Contents string `json:"contents,omitempty"`
+	SHA1     string `json:"sha1"`
+	State    State  `json:"state"`
+}
+
+// Task represents the planned state of a task
+type Task struct {
+	Name        string     `json:"name"`
+	SHA1        string     `json:"sha1,omitempty"`
+	CachedSHA1  string     `json:"cached_sha1,omitempty"`
+	RenamedFrom string     `json:"renamed_from,omitempty"`
+	State       State      `json:"state"`
+	Queued      bool       `json:"queued"`
+	QueuedBy    string     `json:"queued_by,omitempty"`
+	Forced      bool       `json:"forced,omitempty"`
+	Requested   bool       `json:"requested,omitempty"`
+	Skipped     bool       `json:"skipped,omitempty"`
+	Links       []*Link    `json:"links"`
+	Commands    []*Command `json:"commands"`
+
+	task  *task.Task
+	clean bool
+}
+
+// Plan represents the difference between a machine's config and its cache
+type Plan struct {
+	Machine    string  `json:"machine"`
+	SHA1       string  `json:"sha1"`
+	CachedSHA1 string  `json:"cached_sha1,omitempty"`
+	Tasks      []*Task `json:"tasks"`
+}
+
+func newTask(t *task.Task, cachedTask *cache.Task, state State) *Task {
+	// empty lists are marshalled as [] rather than null
+	pt := &Task{
+		Name:     t.Name,
+		SHA1:     t.SHA1,
+		State:    state,
+		Links:    []*Link{},
+		Commands: []*Command{},
+		task:     t,
+	}
+
+	if cachedTask != nil {
+		pt.CachedSHA1 = cachedTask.SHA1
+	}
+
+	// links whose destination was previously provisioned by another link
+	replaced := make(map[string]bool)
+
+	for _, l := range t.Links {
+		pl := &Link{
+			Target:      string(l.Target),
+			Destination: string(l.Destination),
+			Template:    l.Template,
+			Mode:        l.Mode,
+			SHA1:        l.SHA1,
+			State:       state,
+		}
+
+		if cachedTask != nil {
+			pl.cached = cachedTask.Link(l.SHA1)
+		}
+
+		// the links of a changed task are compared individually
+		switch state {
+		case Changed:
+			pl.State = New
+			if pl.cached != nil && !pl.cached.Provisioned() {
+				// a link that was recorded but never created is created again
+				pl.cached = nil
+			} else if pl.cached != nil {
+				pl.State = Unchanged
+			} else if cl := cachedLinkByDestination(cachedTask, t, pl.Destination); cl != nil {
+				pl.State = Changed
+				pl.CachedTarget = cl.Target
+				pl.cached = cl
+				replaced[cl.SHA1] = true
+			}
+		case Renamed:
+			pl.State = Unchanged
+		}
+
+		pt.Links = append(pt.Links, pl)
+	}
+
+	for _, c := range t.Commands {
+		pc := &Command{
+			Contents: c.Contents,
+			SHA1:     c.SHA1,
+			State:    state,
+		}
+
+		// the commands of a changed task are compared individually
+		switch state {
+		case Changed:
+			pc.State = New
+			if cc := cachedTask.Command(c.SHA1); cc != nil && cc.Succeeded() {
+				pc.State = Unchanged
+			}
+		case Renamed:
+			pc.State = Unchanged
+		}
+
+		pt.Commands = append(pt.Commands, pc)
+	}
+
+	if state != Changed {
+		return pt
+	}
+
+	// the links and commands that were provisioned but have since been removed
+	for i, cl := range cachedTask.Links {
+		if t.Link(cl.SHA1) == nil && !replaced[cl.SHA1] {
+			pt.Links = append(pt.Links, removedLink(&cachedTask.Links[i]))
+		}
+	}
+
+	for _, cc := range cachedTask.Commands {
+		if t.Command(cc.SHA1) == nil {
+			pt.Commands = append(pt.Commands, &Command{SHA1: cc.SHA1, State: Removed})
+		}
+	}
+
+	return pt
+}
+
+// cachedLinkByDestination returns the cached link that provisioned the
+// destination, provided that the link is no longer part of the task
+func cachedLinkByDestination(cachedTask *cache.Task, t *task.Task, destination string) *cache.Link {
+	for i, cl := range cachedTask.Links {
+		if t.Link(cl.SHA1) != nil {
+			continue
+		}
+
+		if cl.Destination != "" && cl.Destination == destination {
+			return &cachedTask.Links[i]
+		}
+	}
+
+	return nil
+}
+
+func removedLink(cl *cache.Link) *Link {
+	return &Link{
+		Target:      cl.Target,
+		Destination: cl.Destination,
+		Template:    cl.Template,
+		Mode:        cl.Mode,
+		SHA1:        cl.SHA1,
+		State:       Removed,
+		cached:      cl,
+	}
+}
+
+func removedTask(name string, cachedTask cache.Task) *Task {
+	pt := &Task{
+		Name:       name,
+		CachedSHA1: cachedTask.SHA1,
+		State:      Removed,
+		Links:      []*Link{},
+		Commands:   []*Command{},
+	}
+
+	for i := range cachedTask.Links {
+		pt.Links = append(pt.Links, removedLink(&cachedTask.Links[i]))
+	}
+
+	for _, cc := range cachedTask.Commands {
+		pt.Commands = append(pt.Commands, &Command{SHA1: cc.SHA1, State: Removed})
+	}
+
+	return pt
+}
+
+// NewPlan compares a config to the cached machine, which may be nil if the
+// machine has not been provisioned
+func NewPlan(cfg *config.Config, cachedMachine *cache.Machine) *Plan {
+	p := &Plan{
+		Machine: cfg.Machine,
+		SHA1:    cfg.SHA1,
+		Tasks:   []*Task{},
+	}
+
+	if cachedMachine == nil {
+		for _, t := range cfg.Tasks {
+			p.Tasks = append(p.Tasks, newTask(t, nil, New))
+		}
+	} else {
+		p.compare(cfg, cachedMachine)
+	}
+
+	strategy := cfg.UpdateStrategy
+
+	for _, pt := range p.Tasks {
+		pt.Queued = pt.State == New || pt.State == Changed
+
+		if pt.State == New || pt.State == Removed {
+			continue
+		}
+
+		// the update strategy may provision previously provisioned tasks in full
+		if strategy.Forces(pt.Name) {
+			pt.Queued = true
+			pt.Forced = true
+		}
+
+		pt.clean = strategy.Mode == config.Clean
+	}
+
+	p.queueDependents(cfg)
+
+	return p
+}
+
+func (p *Plan) compare(cfg *config.Config, cachedMachine *cache.Machine) {
+	p.CachedSHA1 = cachedMachine.SHA1
+
+	var cachedNames []string
+	for name := range cachedMachine.Tasks {
+		cachedNames = append(cachedNames, name)
+	}
+
+	sort.Strings(cachedNames)
+
+	for _, t := range cfg.Tasks {
+		if cachedTask, ok := cachedMachine.Tasks[t.Name]; ok {
+			if cachedTask.SHA1 == t.SHA1 {
+				p.Tasks = append(p.Tasks, newTask(t, &cachedTask, Unchanged))
+			} else {
+				p.Tasks = append(p.Tasks, newTask(t, &cachedTask, Changed))
+			}
+
+			continue
+		}
+
+		var renamed *Task
+		for _, cachedTaskName := range cachedNames {
+			cachedTask := cachedMachine.Tasks[cachedTaskName]
+			if cachedTask.SHA1 == t.SHA1 {
+				renamed = newTask(t, &cachedTask, Renamed)
+				renamed.RenamedFrom = cachedTaskName
+
+				break
+			}
+		}
+
+		if renamed != nil {
+			p.Tasks = append(p.Tasks, renamed)
+		} else {
+			p.Tasks = append(p.Tasks, newTask(t, nil, New))
+		}
+	}
+
+	// the tasks that were provisioned but are no longer in the config
+	for _, name := range cachedNames {
+		if p.Task(name) != nil || p.renamedFrom(name) {
+			continue
+		}
+
+		p.Tasks = append(p.Tasks, removedTask(name, cachedMachine.Tasks[name]))
+	}
+}
+
+// queueDependents queues the tasks that depend on a new or changed task,
+// including indirect dependents if the update strategy propagates changes
+func (p *Plan) queueDependents(cfg *config.Config) {
+	for _, pt := range p.Tasks {
+		if pt.State != New && pt.State != Changed {
+			continue
+		}
+
+		dependents := cfg.Dependents(pt.Name)
+		if cfg.UpdateStrategy.Propagate {
+			dependents = cfg.TransitiveDependents(pt.Name)
+		}
+
+		for _, t := range dependents {
+			dt := p.Task(t.Name)
+			if !dt.Queued {
+				dt.Queued = true
+				dt.QueuedBy = pt.Name
+			}
+		}
+	}
+}
+
+// Select limits the plan to the selected tasks, skipping every other task,
+// including the tasks that are no longer in the config. The requested tasks
+// are provisioned in full, whereas the tasks that they depend on are only
+// provisioned if they require it.
+func (p *Plan) Select(selected map[string]bool, requests []string) {
+	for _, pt := range p.Tasks {
+		if !selected[pt.Name] {
+			pt.Queued = false
+			pt.QueuedBy = ""
+			pt.Skipped = true
+		}
+	}
+
+	for _, request := range requests {
+		if pt := p.Task(request); pt != nil && !pt.Skipped {
+			pt.Queued = true
+			pt.Requested = true
+		}
+	}
+}
+
+func (p *Plan) renamedFrom(name string) bool {
+	for _, pt := range p.Tasks {
+		if pt.State == Renamed && pt.RenamedFrom == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Queue marks the tasks, links and commands of the config that require
+// provisioning
+func (p *Plan) Queue() {
+	for _, pt := range p.Tasks {
+		if pt.State == Removed {
+			continue
+		}
+
+		pt.task.Queued = pt.Queued
+
+		// the commands of a task queued by its dependencies are run again,
+		// whereas its links are left in place
+		forced := pt.Forced || pt.Requested
+		rerun := forced || pt.QueuedBy != ""
+
+		for _, l := range pt.Links {
+			if l.State == Removed {
+				continue
+			}
+
+			tl := pt.task.Link(l.SHA1)
+			tl.Queued = l.State != Unchanged || forced
+
+			// what was placed at the destination tells local edits apart
+			if l.cached != nil {
+				tl.Content = l.cached.Content
+			}
+		}
+
+		for _, c := range pt.Commands {
+			if c.State != Removed {
+				pt.task.Command(c.SHA1).Queued = c.State != Unchanged || rerun
+			}
+		}
+	}
+}
+
+// Orphans returns the previously provisioned links of the task that are no
+// longer part of the config, as they were provisioned. A clean update orphans
+// every previously provisioned link.
+func (t *Task) Orphans() []*link.Link {
+	var orphans []*link.Link
+
+	// skipped tasks are left as they are
+	if t.Skipped {
+		return nil
+	}
+
+	for _, l := range t.Links {
+		// links cached before destinations were recorded cannot be located
+		if l.cached == nil || l.cached.Destination == "" {
+			continue
+		}
+
+		switch l.State {
+		case Unchanged:
+			// a clean update removes every link before provisioning it again
+			if t.clean {
+				orphans = append(orphans, l.cached.ToLink())
+			}
+		case Removed, Changed:
+			orphans = append(orphans, l.cached.ToLink())
+		}
+	}
+
+	return orphans
+}
+
+// Task returns the planned state of the named task
+func (p *Plan) Task(name string) *Task {
+	for _, pt := range p.Tasks {
+		if pt.Name == name {
+			return pt
+		}
+	}
+
+	return nil
+}
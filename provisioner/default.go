@@ -1,13 +1,19 @@
 package provisioner
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/autonomy/alterant/cache"
 	"github.com/autonomy/alterant/commander"
 	"github.com/autonomy/alterant/config"
 	"github.com/autonomy/alterant/encrypter"
 	"github.com/autonomy/alterant/environment"
+	"github.com/autonomy/alterant/link"
 	"github.com/autonomy/alterant/linker"
 	"github.com/autonomy/alterant/logger"
+	"github.com/autonomy/alterant/plan"
+	"github.com/autonomy/alterant/repo"
 	"github.com/autonomy/alterant/task"
 	"github.com/codegangsta/cli"
 )
@@ -20,6 +26,34 @@ type DefaultProvisioner struct {
 	Linker      linker.Linker
 	Commander   commander.Commander
 	Cfg         *config.Config
+	DryRun      bool
+	Jobs        int
+	KeepGoing   bool
+	Selection   config.Selection
+}
+
+// partial returns true if only some of the machine's tasks are provisioned
+func (p *DefaultProvisioner) partial() bool {
+	return !p.Selection.Empty()
+}
+
+// newPlan plans the provisioning of the machine, limited to the selected
+// tasks
+func (p *DefaultProvisioner) newPlan(cachedMachine *cache.Machine) (*plan.Plan, error) {
+	pl := plan.NewPlan(p.Cfg, cachedMachine)
+
+	if !p.partial() {
+		return pl, nil
+	}
+
+	selected, err := p.Cfg.Select(&p.Selection)
+	if err != nil {
+		return nil, err
+	}
+
+	pl.Select(selected, p.Selection.Tasks)
+
+	return pl, nil
 }
 
 func (p *DefaultProvisioner) executeTask(task *task.Task) error {
@@ -29,9 +63,6 @@ func (p *DefaultProvisioner) executeTask(task *task.Task) error {
 
 	p.Logger.Info(1, "Attempting task: %s", task.Name)
 
-	// export environment variables specific to the specified machine
-	p.Environment.Set(p.Cfg.Environment)
-
 	// create the links specified in the task
 	err := p.Linker.CreateLinks(task.Links)
 	if err != nil {
@@ -49,26 +80,138 @@ func (p *DefaultProvisioner) executeTask(task *task.Task) error {
 	return nil
 }
 
-// Provision provisions a machine
-func (p *DefaultProvisioner) Provision() error {
+// applyAttributes verifies the permissions and ownership of the files managed by
+// the selected tasks, which may have changed since they were provisioned
+func (p *DefaultProvisioner) applyAttributes() error {
+	var selected map[string]bool
+
+	if p.partial() {
+		var err error
+
+		selected, err = p.Cfg.Select(&p.Selection)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, t := range p.Cfg.Tasks {
+		if selected != nil && !selected[t.Name] {
+			continue
+		}
+
+		err := p.Linker.ApplyAttributes(t.Links)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeOrphans removes the links that alterant created for the tasks, but
+// which are no longer part of the config
+func (p *DefaultProvisioner) removeOrphans(pt *plan.Task) error {
+	orphans := pt.Orphans()
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	p.Logger.Info(1, "Removing orphaned links: %s", pt.Name)
+
+	return p.Linker.RemoveLinks(orphans)
+}
+
+// dryRun prints the plan without provisioning the machine
+func (p *DefaultProvisioner) dryRun(pl *plan.Plan) error {
+	fmt.Printf("Machine: %s\n", pl.Machine)
+
+	// export environment variables specific to the specified machine
+	p.Environment.Set(p.Cfg.Environment)
+
+	for _, pt := range pl.Tasks {
+		fmt.Printf("  task %s\n", pt.Summary())
+
+		err := p.removeOrphans(pt)
+		if err != nil {
+			return err
+		}
+
+		if pt.State == plan.Removed {
+			continue
+		}
+
+		err = p.executeTask(p.Cfg.Task(pt.Name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *DefaultProvisioner) provision(pl *plan.Plan) error {
+	pl.Queue()
+
+	if p.DryRun {
+		return p.dryRun(pl)
+	}
+
 	p.Logger.Info(0, "Provisioning: %s", p.Cfg.Machine)
 
+	// the commit that the provisioned links and commands originate from
+	commit, err := repo.HeadCommit()
+	if err != nil {
+		return err
+	}
+
+	// the targets of inherited links are exported from the extended machines
+	err = p.Cfg.ExportExtended()
+	if err != nil {
+		return err
+	}
+
+	// verify every link that is about to be created before making any change
+	err = p.Linker.ValidateLinks(p.Cfg.Tasks)
+	if err != nil {
+		return err
+	}
+
 	// decrypt files
-	err := p.Encrypter.DecryptFiles(p.Cfg)
+	err = p.Encrypter.DecryptFiles(p.Cfg)
 	if err != nil {
 		return err
 	}
 
-	for _, task := range p.Cfg.Tasks {
-		err = p.executeTask(task)
+	// remove orphaned links first, as their destinations may be reused
+	for _, pt := range pl.Tasks {
+		err = p.removeOrphans(pt)
 		if err != nil {
 			return err
 		}
 	}
 
+	// export environment variables specific to the specified machine
+	p.Environment.Set(p.Cfg.Environment)
+
+	err = p.executeTasks(commit)
+	if err != nil {
+		return err
+	}
+
+	err = p.applyAttributes()
+	if err != nil {
+		return err
+	}
+
 	p.Logger.Info(0, "Provisioned: %s", p.Cfg.Machine)
 
-	err = cache.WriteToFile(p.Cfg)
+	// the outcome of each task has already been recorded, a partial run leaves
+	// the rest of the machine to be compared in full by the next update
+	if p.partial() {
+		return nil
+	}
+
+	err = cache.WriteToFile(p.Cfg, commit)
 	if err != nil {
 		return err
 	}
@@ -76,93 +219,214 @@ func (p *DefaultProvisioner) Provision() error {
 	return nil
 }
 
+// Provision provisions a machine
+func (p *DefaultProvisioner) Provision() error {
+	pl, err := p.newPlan(nil)
+	if err != nil {
+		return err
+	}
+
+	return p.provision(pl)
+}
+
 // Update updates a machine's tasks
 func (p *DefaultProvisioner) Update() error {
-	cache, err := cache.ReadCache()
+	cachedMachine, err := cache.ReadMachine(p.Cfg.Machine)
 	if err != nil {
 		return err
 	}
 
-	if cachedMachine, ok := cache.Machines[p.Cfg.Machine]; ok {
-		if cachedMachine.SHA1 == p.Cfg.SHA1 {
-			p.Logger.Info(0, "Machine up to date: %s", p.Cfg.Machine)
+	if cachedMachine == nil {
+		return p.Provision()
+	}
+
+	// requested tasks are provisioned even if the machine is up to date
+	if cachedMachine.SHA1 == p.Cfg.SHA1 && !p.Cfg.UpdateStrategy.ForcesAny() && len(p.Selection.Tasks) == 0 {
+		p.Logger.Info(0, "Machine up to date: %s", p.Cfg.Machine)
 
-			return nil
+		if p.DryRun {
+			fmt.Printf("Machine up to date: %s\n", p.Cfg.Machine)
 		}
 
-		p.Logger.Info(0, "Preparing machine for update: %s", p.Cfg.Machine)
-
-		for _, task := range p.Cfg.Tasks {
-			if cachedTask, ok := cachedMachine.Tasks[task.Name]; ok {
-				if cachedTask.SHA1 == task.SHA1 {
-					task.Queued = false
-				} else {
-					p.Logger.Info(1, "Task queued for update: %s", task.Name)
-
-					// update the links
-					for _, SHA1 := range cachedTask.Links {
-						if link, ok := task.Links[SHA1]; ok {
-							link.Queued = false
-						}
-					}
-
-					// update the commands
-					for _, SHA1 := range cachedTask.Commands {
-						if command, ok := task.Commands[SHA1]; ok {
-							command.Queued = false
-						}
-					}
-				}
-
-				// update the cache
-				delete(cachedMachine.Tasks, task.Name)
-				cache.AddTask(cachedMachine, task)
-			} else {
-				for cachedTaskName, cachedTask := range cachedMachine.Tasks {
-					if cachedTask.SHA1 == task.SHA1 {
-						p.Logger.Info(1, "Task renamed: %s -> %s", cachedTaskName, task.Name)
-
-						task.Queued = false
-
-						// update the cache
-						delete(cachedMachine.Tasks, task.Name)
-						cache.AddTask(cachedMachine, task)
-
-						break
-					}
-				}
-			}
+		return p.applyAttributes()
+	}
+
+	p.Logger.Info(0, "Preparing machine for update: %s", p.Cfg.Machine)
+
+	pl, err := p.newPlan(cachedMachine)
+	if err != nil {
+		return err
+	}
+
+	for _, pt := range pl.Tasks {
+		switch {
+		case pt.Skipped:
+			p.Logger.Info(1, "Task skipped: %s", pt.Name)
+		case pt.Requested:
+			p.Logger.Info(1, "Task requested: %s", pt.Name)
+		case pt.State == plan.Changed:
+			p.Logger.Info(1, "Task queued for update: %s", pt.Name)
+		case pt.Forced:
+			p.Logger.Info(1, "Task queued by update strategy: %s", pt.Name)
+		case pt.QueuedBy != "":
+			p.Logger.Info(1, "Task queued by dependency: %s -> %s", pt.QueuedBy, pt.Name)
+		case pt.State == plan.Renamed:
+			p.Logger.Info(1, "Task renamed: %s -> %s", pt.RenamedFrom, pt.Name)
+		case pt.State == plan.Removed:
+			p.Logger.Info(1, "Task removed: %s", pt.Name)
+		}
+	}
+
+	return p.provision(pl)
+}
+
+// provisionedLinks returns the links of the task as they were provisioned, so
+// that placed files are compared with the contents that were placed
+func provisionedLinks(task *task.Task, cachedTask *cache.Task) []*link.Link {
+	var links []*link.Link
+
+	for _, l := range task.Links {
+		if cl := cachedTask.Link(l.SHA1); cl != nil && cl.Destination != "" {
+			links = append(links, cl.ToLink())
+		} else {
+			links = append(links, l)
 		}
 	}
 
-	p.Provision()
+	return links
+}
+
+func (p *DefaultProvisioner) removeTask(task *task.Task, cachedTask *cache.Task) error {
+	p.Logger.Info(1, "Removing task: %s", task.Name)
+
+	// execute the teardown commands specified in the task
+	err := p.Commander.Teardown(task)
+	if err != nil {
+		return err
+	}
+
+	// remove the links specified in the task
+	links := task.Links
+	if cachedTask != nil {
+		links = provisionedLinks(task, cachedTask)
+	}
+
+	err = p.Linker.RemoveLinks(links)
+	if err != nil {
+		return err
+	}
+
+	p.Logger.Info(1, "Task removed: %s", task.Name)
 
 	return nil
 }
 
 // Remove removes provisioned tasks
 func (p *DefaultProvisioner) Remove(requests []string) error {
-	p.Logger.Info(2, "Removing: %s", p.Cfg.Machine)
+	p.Logger.Info(0, "Removing: %s", p.Cfg.Machine)
+
+	requested := make(map[string]bool)
+	for _, request := range requests {
+		requested[request] = true
+	}
+
+	known := make(map[string]bool)
 	for _, task := range p.Cfg.Tasks {
-		p.Linker.RemoveLinks(task.Links)
+		known[task.Name] = true
+	}
+
+	for _, request := range requests {
+		if !known[request] {
+			return fmt.Errorf("Unknown task: %s", request)
+		}
+	}
+
+	cachedMachine, err := cache.ReadMachine(p.Cfg.Machine)
+	if err != nil {
+		return err
+	}
+
+	var removed []string
+
+	// remove tasks in reverse order so that dependents are removed first
+	for i := len(p.Cfg.Tasks) - 1; i >= 0; i-- {
+		task := p.Cfg.Tasks[i]
+		if !requested[task.Name] {
+			continue
+		}
+
+		var cachedTask *cache.Task
+		if cachedMachine != nil {
+			if t, ok := cachedMachine.Tasks[task.Name]; ok {
+				cachedTask = &t
+			}
+		}
+
+		err = p.removeTask(task, cachedTask)
+		if err != nil {
+			break
+		}
+
+		removed = append(removed, task.Name)
+	}
+
+	// record the tasks that were removed, even if a later task failed
+	cacheErr := cache.RemoveTasks(p.Cfg.Machine, removed)
+	if err != nil {
+		return err
+	}
+
+	if cacheErr != nil {
+		return cacheErr
 	}
 
+	p.Logger.Info(0, "Removed: %s", p.Cfg.Machine)
+
 	return nil
 }
 
+// splitList splits comma separated flag values, so that both `--tags a,b` and
+// `--tags a --tags b` are accepted
+func splitList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+
+	return list
+}
+
 // NewDefaultProvisioner returns an instance of a `DefaultProvisioner`
 func NewDefaultProvisioner(cfg *config.Config, c *cli.Context) *DefaultProvisioner {
 	logger := logWrapper.NewLogWrapper(c.GlobalBool("verbose"))
 
+	// the command line may override the update strategy of the config
+	if c.Bool("propagate") {
+		cfg.UpdateStrategy.Propagate = true
+	}
+
 	p := &DefaultProvisioner{
 		Logger:      logger,
 		Environment: environment.NewEnvironment(cfg.Machine, logger),
 		Encrypter: encrypter.NewDefaultEncryption(c.GlobalString("password"),
 			c.GlobalString("private"), c.GlobalString("public"), c.BoolT("remove"), logger),
 		Linker: linker.NewDefaultLinker(c.BoolT("links"), c.Bool("parents"),
-			c.Bool("clobber"), logger),
-		Commander: commander.NewDefaultCommander(c.BoolT("commands"), logger),
+			c.Bool("clobber"), c.BoolT("backup"), c.Bool("dry-run"), logger),
+		Commander: commander.NewDefaultCommander(c.BoolT("commands"), c.Bool("dry-run"), logger),
 		Cfg:       cfg,
+		DryRun:    c.Bool("dry-run"),
+		Jobs:      c.Int("jobs"),
+		KeepGoing: c.Bool("keep-going"),
+		Selection: config.Selection{
+			Tasks:    c.StringSlice("task"),
+			Skip:     c.StringSlice("skip"),
+			Tags:     splitList(c.StringSlice("tags")),
+			SkipTags: splitList(c.StringSlice("skip-tags")),
+		},
 	}
 
 	return p
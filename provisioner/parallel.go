@@ -0,0 +1,169 @@
+package provisioner
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/autonomy/alterant/cache"
+	"github.com/autonomy/alterant/logger"
+	"github.com/autonomy/alterant/task"
+)
+
+// executor runs the queued tasks of a machine, running up to `jobs` tasks
+// of the same dependency layer concurrently
+type executor struct {
+	p      *DefaultProvisioner
+	commit string
+
+	// mu guards the fields below, the cache and the flushing of output
+	mu       sync.Mutex
+	failed   map[string]bool
+	failures []string
+	err      error
+}
+
+// dependencyFailed returns the name of a dependency of the task that failed
+// or was skipped, if any
+func (e *executor) dependencyFailed(t *task.Task) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, dep := range t.Dependencies {
+		if e.failed[dep] {
+			return dep
+		}
+	}
+
+	return ""
+}
+
+func (e *executor) stopped() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.err != nil && !e.p.KeepGoing
+}
+
+func (e *executor) fail(t *task.Task, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.failed[t.Name] = true
+	e.failures = append(e.failures, fmt.Sprintf("%s: %s", t.Name, err))
+
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+// run executes a single task, buffering its output when tasks run
+// concurrently so that the output of each task is displayed as a whole
+func (e *executor) run(t *task.Task) error {
+	worker := e.p
+
+	var buf *bytes.Buffer
+	if e.p.Jobs > 1 {
+		buf = &bytes.Buffer{}
+		logger := logWrapper.NewBufferedLogWrapper(e.p.Logger.Verbose, buf)
+
+		w := *e.p
+		w.Logger = logger
+		w.Linker = e.p.Linker.WithLogger(logger)
+		w.Commander = e.p.Commander.WithLogger(logger)
+		worker = &w
+	}
+
+	err := worker.executeTask(t)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if buf != nil {
+		os.Stderr.Write(buf.Bytes())
+	}
+
+	// record the outcome of the task, even if it failed
+	cacheErr := cache.WriteTask(e.p.Cfg.Machine, e.commit, t, err != nil)
+	if err != nil {
+		return err
+	}
+
+	return cacheErr
+}
+
+func (e *executor) executeLayer(layer []*task.Task) {
+	var wg sync.WaitGroup
+	jobs := make(chan struct{}, e.p.Jobs)
+
+	for _, t := range layer {
+		if !t.Queued {
+			continue
+		}
+
+		if dep := e.dependencyFailed(t); dep != "" {
+			e.p.Logger.Info(1, "Task skipped, dependency failed: %s -> %s", dep, t.Name)
+
+			e.mu.Lock()
+			e.failed[t.Name] = true
+			e.mu.Unlock()
+
+			continue
+		}
+
+		jobs <- struct{}{}
+
+		// do not start any more tasks once a task has failed
+		if e.stopped() {
+			<-jobs
+			break
+		}
+
+		wg.Add(1)
+		go func(t *task.Task) {
+			defer wg.Done()
+			defer func() { <-jobs }()
+
+			err := e.run(t)
+			if err != nil {
+				e.fail(t, err)
+			}
+		}(t)
+	}
+
+	wg.Wait()
+}
+
+// executeTasks executes the queued tasks layer by layer. By default the first
+// failure stops provisioning, otherwise only the dependents of failed tasks
+// are skipped.
+func (p *DefaultProvisioner) executeTasks(commit string) error {
+	if p.Jobs < 1 {
+		p.Jobs = 1
+	}
+
+	e := &executor{
+		p:      p,
+		commit: commit,
+		failed: make(map[string]bool),
+	}
+
+	for _, layer := range p.Cfg.Layers {
+		e.executeLayer(layer)
+
+		if e.stopped() {
+			return e.err
+		}
+	}
+
+	switch len(e.failures) {
+	case 0:
+		return nil
+	case 1:
+		return e.err
+	default:
+		return fmt.Errorf("%d tasks failed:\n%s", len(e.failures), strings.Join(e.failures, "\n"))
+	}
+}
@@ -1,11 +1,14 @@
 package repo
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"time"
 
 	"github.com/libgit2/git2go"
@@ -349,3 +352,190 @@ func Pull(machine string) error {
 
 	return nil
 }
+
+// HeadCommit returns the commit that HEAD of the current machine points to
+func HeadCommit() (string, error) {
+	repo, err := git.OpenRepository(repoPath)
+	if err != nil {
+		return "", err
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return "", err
+	}
+
+	return head.Target().String(), nil
+}
+
+// Branch reads the files of a machine's branch without checking it out
+type Branch struct {
+	Machine string
+	repo    *git.Repository
+	tree    *git.Tree
+}
+
+// OpenBranch opens the branch of a machine, falling back to the remote branch
+// if the machine has no local branch
+func OpenBranch(machine string) (*Branch, error) {
+	repo, err := git.OpenRepository(repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	branch, err := repo.LookupBranch(machine, git.BranchLocal)
+	if err != nil {
+		branch, err = repo.LookupBranch("origin/"+machine, git.BranchRemote)
+		if err != nil {
+			return nil, fmt.Errorf("Unknown machine: %s", machine)
+		}
+	}
+
+	commit, err := repo.LookupCommit(branch.Target())
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Branch{Machine: machine, repo: repo, tree: tree}, nil
+}
+
+// ReadFile returns the contents of a file in the branch
+func (b *Branch) ReadFile(name string) ([]byte, error) {
+	entry, err := b.tree.EntryByPath(filepath.ToSlash(filepath.Clean(name)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: no such file in %s", name, b.Machine)
+	}
+
+	blob, err := b.repo.LookupBlob(entry.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return blob.Contents(), nil
+}
+
+// Files returns the paths of every file in the branch, mapped to their modes
+func (b *Branch) Files() (map[string]os.FileMode, error) {
+	files := make(map[string]os.FileMode)
+
+	err := b.tree.Walk(func(root string, entry *git.TreeEntry) int {
+		if entry.Type != git.ObjectBlob {
+			return 0
+		}
+
+		files[root+entry.Name] = 0644
+		if entry.Filemode == git.FilemodeBlobExecutable {
+			files[root+entry.Name] = 0755
+		}
+
+		return 0
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// Glob returns the files in the branch that match the pattern
+func (b *Branch) Glob(pattern string) ([]string, error) {
+	files, err := b.Files()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []string
+	for file := range files {
+		ok, err := filepath.Match(pattern, file)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			matches = append(matches, file)
+		}
+	}
+
+	sort.Strings(matches)
+
+	return matches, nil
+}
+
+// Export writes the files of the branch to dir. Files that are already up to
+// date are left untouched, so that links to them are not disturbed, and files
+// that are no longer in the branch are removed.
+func (b *Branch) Export(dir string) error {
+	files, err := b.Files()
+	if err != nil {
+		return err
+	}
+
+	for file, mode := range files {
+		contents, err := b.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		dest := filepath.Join(dir, filepath.FromSlash(file))
+
+		if existing, err := ioutil.ReadFile(dest); err == nil && bytes.Equal(existing, contents) {
+			continue
+		}
+
+		err = os.MkdirAll(filepath.Dir(dest), 0755)
+		if err != nil {
+			return err
+		}
+
+		err = ioutil.WriteFile(dest, contents, mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	return prune(dir, files)
+}
+
+// prune removes the files in dir that are not among the files of a branch,
+// along with any directories that are left empty
+func prune(dir string, files map[string]os.FileMode) error {
+	var dirs []string
+
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			dirs = append(dirs, file)
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := files[filepath.ToSlash(rel)]; !ok {
+			return os.Remove(file)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// remove the deepest directories first, so that their parents may become
+	// empty, whereas directories that still have files fail to be removed
+	for i := len(dirs) - 1; i > 0; i-- {
+		os.Remove(dirs[i])
+	}
+
+	return nil
+}
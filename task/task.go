@@ -2,6 +2,7 @@ package task
 
 import (
 	"github.com/autonomy/alterant/command"
+	"github.com/autonomy/alterant/condition"
 	"github.com/autonomy/alterant/hasher"
 	"github.com/autonomy/alterant/link"
 	"gopkg.in/yaml.v2"
@@ -10,46 +11,188 @@ import (
 // Task represents a task
 type Task struct {
 	Dependencies []string
-	Links        map[string]*link.Link
-	Commands     map[string]*command.Command
+	Links        []*link.Link
+	Commands     []*command.Command
+	Teardown     []*command.Command
+	Tags         []string
+	When         *condition.Condition `yaml:"-"`
 	Name         string
 	Queued       bool
 	SHA1         string
 }
 
-func (t *Task) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	var aux struct {
-		Dependencies []string           `yaml:"dependencies"`
-		Links        []*link.Link       `yaml:"links"`
-		Commands     []*command.Command `yaml:"commands"`
+// uniqueLinks removes duplicate links, preserving the order of declaration
+func uniqueLinks(links []*link.Link) []*link.Link {
+	var unique []*link.Link
+	seen := make(map[string]bool)
+
+	for _, link := range links {
+		if !seen[link.SHA1] {
+			seen[link.SHA1] = true
+			unique = append(unique, link)
+		}
 	}
 
-	err := unmarshal(&aux)
-	if err != nil {
-		return err
+	return unique
+}
+
+// uniqueCommands removes duplicate commands, preserving the order of
+// declaration
+func uniqueCommands(commands []*command.Command) []*command.Command {
+	var unique []*command.Command
+	seen := make(map[string]bool)
+
+	for _, command := range commands {
+		if !seen[command.SHA1] {
+			seen[command.SHA1] = true
+			unique = append(unique, command)
+		}
 	}
 
-	links := make(map[string]*link.Link)
-	for _, link := range aux.Links {
-		links[link.SHA1] = link
+	return unique
+}
+
+// declaration is a task as declared in the machine yaml
+type declaration struct {
+	Dependencies []string             `yaml:"dependencies"`
+	Links        []*link.Link         `yaml:"links"`
+	Commands     []*command.Command   `yaml:"commands"`
+	Teardown     []*command.Command   `yaml:"teardown,omitempty"`
+	Tags         []string             `yaml:"tags,omitempty"`
+	When         *condition.Condition `yaml:"when,omitempty"`
+}
+
+// hash returns the SHA1 of the declaration. Tags and conditions select a task
+// rather than alter it, so they are not hashed.
+func (d declaration) hash() (string, error) {
+	d.Tags = nil
+	d.When = nil
+
+	b, err := yaml.Marshal(&d)
+	if err != nil {
+		return "", err
 	}
 
-	commands := make(map[string]*command.Command)
-	for _, command := range aux.Commands {
-		commands[command.SHA1] = command
+	return hasher.SHA1FromBytes(b), nil
+}
+
+func (t *Task) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var aux declaration
+
+	err := unmarshal(&aux)
+	if err != nil {
+		return err
 	}
 
-	b, err := yaml.Marshal(&aux)
+	SHA1, err := aux.hash()
 	if err != nil {
 		return err
 	}
 
 	*t = Task{
 		Dependencies: aux.Dependencies,
-		Links:        links,
-		Commands:     commands,
+		Links:        uniqueLinks(aux.Links),
+		Commands:     uniqueCommands(aux.Commands),
+		Teardown:     uniqueCommands(aux.Teardown),
+		Tags:         aux.Tags,
+		When:         aux.When,
 		Queued:       true,
-		SHA1:         hasher.SHA1FromBytes(b),
+		SHA1:         SHA1,
+	}
+
+	return nil
+}
+
+// Filter removes the links and commands of the task whose conditions are not
+// met. The SHA1 of the task then describes only what remains, so that the
+// task changes when a condition does.
+func (t *Task) Filter(environment map[string]string) error {
+	filtered := false
+
+	var links []*link.Link
+	for _, link := range t.Links {
+		if link.When.Met(environment) {
+			links = append(links, link)
+		} else {
+			filtered = true
+		}
+	}
+
+	filterCommands := func(commands []*command.Command) []*command.Command {
+		var met []*command.Command
+		for _, command := range commands {
+			if command.When.Met(environment) {
+				met = append(met, command)
+			} else {
+				filtered = true
+			}
+		}
+
+		return met
+	}
+
+	commands := filterCommands(t.Commands)
+	teardown := filterCommands(t.Teardown)
+
+	if !filtered {
+		return nil
+	}
+
+	t.Links = links
+	t.Commands = commands
+	t.Teardown = teardown
+
+	return t.Rehash()
+}
+
+// Rehash recomputes the SHA1 of the task from its dependencies, links and
+// commands, after any of them has changed
+func (t *Task) Rehash() error {
+	SHA1, err := declaration{
+		Dependencies: t.Dependencies,
+		Links:        t.Links,
+		Commands:     t.Commands,
+		Teardown:     t.Teardown,
+	}.hash()
+	if err != nil {
+		return err
+	}
+
+	t.SHA1 = SHA1
+
+	return nil
+}
+
+// HasTag returns true if the task is tagged with any of the tags
+func (t *Task) HasTag(tags ...string) bool {
+	for _, tag := range t.Tags {
+		for _, other := range tags {
+			if tag == other {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Link returns the link with the given SHA1, or nil
+func (t *Task) Link(SHA1 string) *link.Link {
+	for _, link := range t.Links {
+		if link.SHA1 == SHA1 {
+			return link
+		}
+	}
+
+	return nil
+}
+
+// Command returns the command with the given SHA1, or nil
+func (t *Task) Command(SHA1 string) *command.Command {
+	for _, command := range t.Commands {
+		if command.SHA1 == SHA1 {
+			return command
+		}
 	}
 
 	return nil
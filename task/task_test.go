@@ -0,0 +1,86 @@
+package task
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const orderedTask = `
+links:
+  - target: zshrc
+    destination: .zshrc
+  - target: bashrc
+    destination: .bashrc
+  - target: zshrc
+    destination: .zshrc
+  - target: aliases
+    destination: .aliases
+commands:
+  - echo three
+  - echo one
+  - echo three
+  - echo two
+teardown:
+  - echo b
+  - echo a
+`
+
+func TestDeclarationOrder(t *testing.T) {
+	home := os.Getenv("HOME")
+
+	expectedLinks := []string{
+		path.Join(home, ".zshrc"),
+		path.Join(home, ".bashrc"),
+		path.Join(home, ".aliases"),
+	}
+	expectedCommands := []string{"echo three", "echo one", "echo two"}
+	expectedTeardown := []string{"echo b", "echo a"}
+
+	var SHA1 string
+
+	for i := 0; i < 20; i++ {
+		var task Task
+
+		err := yaml.Unmarshal([]byte(orderedTask), &task)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var links []string
+		for _, l := range task.Links {
+			links = append(links, string(l.Destination))
+		}
+
+		if !reflect.DeepEqual(links, expectedLinks) {
+			t.Fatalf("load %d: expected links %v, got %v", i, expectedLinks, links)
+		}
+
+		var commands []string
+		for _, c := range task.Commands {
+			commands = append(commands, c.Contents)
+		}
+
+		if !reflect.DeepEqual(commands, expectedCommands) {
+			t.Fatalf("load %d: expected commands %v, got %v", i, expectedCommands, commands)
+		}
+
+		var teardown []string
+		for _, c := range task.Teardown {
+			teardown = append(teardown, c.Contents)
+		}
+
+		if !reflect.DeepEqual(teardown, expectedTeardown) {
+			t.Fatalf("load %d: expected teardown %v, got %v", i, expectedTeardown, teardown)
+		}
+
+		if i > 0 && task.SHA1 != SHA1 {
+			t.Fatalf("load %d: expected SHA1 %s, got %s", i, SHA1, task.SHA1)
+		}
+
+		SHA1 = task.SHA1
+	}
+}